@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// adoptPollInterval is the period to check whether an adopted process exited,
+// only used if pidfd is not supported by the kernel
+const adoptPollInterval time.Duration = 1 * time.Second
+
+// errAdoptedExited is returned when an adopted process exits, since it's not
+// a child of the supervisor, the exit status can't be known
+var errAdoptedExited = errors.New("adopted process exited with unknown status")
+
+// isAdoptable returns true if the process is running the configured command
+func isAdoptable(cfg *Config, pid int) bool {
+	args, err := readProcCmdline(pid)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+	if args[0] != cfg.Cmd || len(args)-1 != len(cfg.Args) {
+		return false
+	}
+	for i, arg := range cfg.Args {
+		if args[i+1] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// Adopt monitors an already running process which is not started by us,
+// its output is not captured and its exit status is unknown
+func (p *process) Adopt(pid int) error {
+	ticks, err := readProcStartTicks(pid)
+	if err != nil {
+		return err
+	}
+	sTime, err := readProcStartTime(pid)
+	if err != nil {
+		return err
+	}
+	p.pid = pid
+	p.adopted = true
+	p.startTicks = ticks
+	p.sTime = sTime
+	p.errch = make(chan error, 1)
+	p.exitch = make(chan struct{})
+
+	go func() {
+		waitExit(pid, ticks)
+		p.eTime = time.Now()
+		close(p.exitch)
+		p.errch <- errAdoptedExited
+	}()
+	return nil
+}
+
+// waitExit blocks until the process started at the ticks exits, it uses pidfd if possible.
+// The start ticks tell a reused pid from the process
+func waitExit(pid int, ticks uint64) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == nil && !isSameProcess(pid, ticks) {
+		// the pid is reused before the pidfd is opened
+		unix.Close(fd)
+		return
+	}
+	if err == nil {
+		defer unix.Close(fd)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for {
+			// the pidfd becomes readable when the process exits
+			n, err := unix.Poll(fds, -1)
+			if err == unix.EINTR {
+				continue
+			}
+			if err == nil && n > 0 {
+				return
+			}
+			log.Warnf("poll pidfd of process [%d] failed: %v, fall back to polling", pid, err)
+			break
+		}
+	}
+	for !isExited(pid) && isSameProcess(pid, ticks) {
+		time.Sleep(adoptPollInterval)
+	}
+}
+
+// warnPipedOutput warns if the stdout or stderr of the adopted process is a pipe,
+// the pipe was read by the previous supervisor which has exited, so the next write
+// of the process fails with EPIPE or kills it by SIGPIPE
+func warnPipedOutput(name string, pid int) {
+	for fd, stream := range []string{1: "stdout", 2: "stderr"} {
+		if stream == "" {
+			continue
+		}
+		target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+		if err == nil && strings.HasPrefix(target, "pipe:") {
+			log.WithField("daemon", name).Warnf("%s of adopted process [%d] is a pipe to the exited supervisor, "+
+				"writing to it may kill the process, make the process log to files instead", stream, pid)
+		}
+	}
+}
+
+// adopt makes the running process managed by the daemon, it goes to RUNNING state directly
+func (d *Daemon) adopt(pid int) error {
+	// if already locked, not need to adopt the process
+	if atomic.SwapUint32(&d.lock, uint32(1)) != 0 {
+		return nil
+	}
+
+	p := &process{Config: d.cfg}
+	if err := p.Adopt(pid); err != nil {
+		return errors.Wrapf(err, "adopt process [%d] failed", pid)
+	}
+	log.WithField("daemon", d.cfg.Name).Infof("adopted running process [%d]", pid)
+	warnPipedOutput(d.cfg.Name, pid)
+
+	d.proc = p
+	d.runStat.Lock()
+	d.runStat.RunCount++
+	d.runStat.StartTime = p.sTime
+	d.runStat.Pid = pid
+	d.runStat.Unlock()
+	d.emitProcessEvent(sink.EventProcessStarted, nil)
+	d.startSampler(pid)
+
+	d.changeToState(ProcStatRunning)
+	d.startProbes()
+	return nil
+}
@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+// startOrphan starts the command as if it was started by a previous supervisor
+func startOrphan(t *testing.T, cfg *Config, args ...string) *exec.Cmd {
+	cmd := exec.Command(cfg.Cmd, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	assert.NoError(t, cmd.Start())
+	ticks, err := readProcStartTicks(cmd.Process.Pid)
+	assert.NoError(t, err)
+	assert.NoError(t, writePidFile(cfg.StatusDir+"/"+cfg.Name+".pid", cmd.Process.Pid, ticks))
+	return cmd
+}
+
+func TestAdoptRunningProcess(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_adopt_running_process")
+	cfg.Adopt = true
+	cmd := startOrphan(t, cfg, cfg.Args...)
+	pid := cmd.Process.Pid
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise, the process is adopted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.Equal(t, pid, d.proc.Pid())
+	assert.Equal(t, pid, d.GetRunningStat().Pid)
+	assert.Equal(t, uint32(1), d.GetRunningStat().RunCount)
+	assert.True(t, isRunning(pid))
+	// the adopted process exits, a new process is started
+	assert.NoError(t, cmd.Process.Kill())
+	waitForState(t, events, ProcStatExited)
+	_ = cmd.Wait()
+	waitForState(t, events, ProcStatRunning)
+	assert.NotEqual(t, pid, d.proc.Pid())
+	stat := d.GetRunningStat()
+	assert.Equal(t, uint32(2), stat.RunCount)
+	assert.Equal(t, errAdoptedExited, stat.LastExitErr)
+}
+
+func TestAdoptChangedCommand(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_adopt_changed_command")
+	cfg.Adopt = true
+	// the recorded process runs a command different from the config
+	cmd := startOrphan(t, cfg, "3601")
+	pid := cmd.Process.Pid
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// the recorded process is killed instead of adopted
+	_ = cmd.Wait()
+	assert.False(t, isRunning(pid))
+	// start to supervise, a new process is started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.NotEqual(t, pid, d.proc.Pid())
+}
+
+func TestWaitExitReusedPid(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	ticks, err := readProcStartTicks(pid)
+	assert.NoError(t, err)
+	// the pid belongs to another process started at different ticks
+	donec := make(chan struct{})
+	go func() {
+		waitExit(pid, ticks+1)
+		close(donec)
+	}()
+	select {
+	case <-donec:
+	case <-time.After(time.Second):
+		t.Fatal("waitExit blocks on a reused pid")
+	}
+}
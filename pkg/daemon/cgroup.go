@@ -0,0 +1,169 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const defaultCPUPeriod time.Duration = 100 * time.Millisecond
+
+// CgroupConfig puts the process into its own cgroup v2 directory <Root>/<Name>,
+// the settings are applied to the whole process tree. Zero values mean no limit
+type CgroupConfig struct {
+	// Root is the delegated cgroup v2 directory to create the daemon's cgroup in,
+	// e.g. /sys/fs/cgroup/tipervisor
+	Root string
+	// MemoryMax is the hard memory limit in bytes, memory.max
+	MemoryMax int64
+	// MemoryHigh is the memory throttle limit in bytes, memory.high
+	MemoryHigh int64
+	// CPUQuota is the CPU time allowed in each CPUPeriod, cpu.max,
+	// e.g. 200ms per 100ms means two CPUs
+	CPUQuota time.Duration
+	// CPUPeriod is the period of CPUQuota, default is 100ms
+	CPUPeriod time.Duration
+	// IOWeight is the proportional IO weight in [1, 10000], io.weight
+	IOWeight int
+	// PidsMax is the max number of processes and threads, pids.max
+	PidsMax int
+}
+
+type cgroupSetting struct {
+	controller string
+	file       string
+	// value is empty if not set
+	value string
+	// reset is the value to clear the setting left by previous runs
+	reset string
+}
+
+func (c *CgroupConfig) settings() []cgroupSetting {
+	settings := []cgroupSetting{
+		{controller: "memory", file: "memory.max", reset: "max"},
+		{controller: "memory", file: "memory.high", reset: "max"},
+		{controller: "cpu", file: "cpu.max", reset: "max"},
+		{controller: "io", file: "io.weight", reset: "default 100"},
+		{controller: "pids", file: "pids.max", reset: "max"},
+	}
+	if c.MemoryMax > 0 {
+		settings[0].value = fmt.Sprintf("%d", c.MemoryMax)
+	}
+	if c.MemoryHigh > 0 {
+		settings[1].value = fmt.Sprintf("%d", c.MemoryHigh)
+	}
+	if c.CPUQuota > 0 {
+		settings[2].value = fmt.Sprintf("%d %d", c.CPUQuota.Microseconds(), c.CPUPeriod.Microseconds())
+	}
+	if c.IOWeight > 0 {
+		settings[3].value = fmt.Sprintf("default %d", c.IOWeight)
+	}
+	if c.PidsMax > 0 {
+		settings[4].value = fmt.Sprintf("%d", c.PidsMax)
+	}
+	return settings
+}
+
+func checkCgroup(cfg *Config) error {
+	c := cfg.Cgroup
+	if c == nil {
+		return nil
+	}
+	if c.Root == "" {
+		return errors.New("cgroup root is required")
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(c.Root, &st); err != nil {
+		return errors.Wrapf(err, "stat cgroup root [%s] failed", c.Root)
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return errors.Errorf("cgroup root [%s] is not a cgroup v2 directory", c.Root)
+	}
+	if c.MemoryMax < 0 || c.MemoryHigh < 0 || c.CPUQuota < 0 || c.PidsMax < 0 {
+		return errors.New("cgroup limits must not be negative")
+	}
+	if c.CPUPeriod <= 0 {
+		c.CPUPeriod = defaultCPUPeriod
+	}
+	if c.IOWeight < 0 || c.IOWeight > 10000 {
+		return errors.Errorf("invalid io weight [%d], should be in [1, 10000]", c.IOWeight)
+	}
+	cfg.cgroup = filepath.Join(c.Root, cfg.Name)
+	return setupCgroup(cfg.cgroup, c)
+}
+
+// setupCgroup creates the cgroup directory and writes the settings,
+// the controllers in use are enabled in the root if they are not yet
+func setupCgroup(dir string, c *CgroupConfig) error {
+	settings := c.settings()
+	var controllers []string
+	for _, s := range settings {
+		if s.value != "" {
+			controllers = append(controllers, s.controller)
+		}
+	}
+	if err := enableControllers(c.Root, controllers); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return errors.Wrapf(err, "create cgroup [%s] failed", dir)
+	}
+	for _, s := range settings {
+		file := filepath.Join(dir, s.file)
+		value := s.value
+		if value == "" {
+			if _, err := os.Stat(file); err != nil {
+				// the controller isn't enabled, nothing to reset
+				continue
+			}
+			value = s.reset
+		}
+		if err := ioutil.WriteFile(file, []byte(value), 0644); err != nil {
+			return errors.Wrapf(err, "set cgroup %s to [%s] failed", s.file, value)
+		}
+	}
+	return nil
+}
+
+func enableControllers(root string, controllers []string) error {
+	data, err := ioutil.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+	if err != nil {
+		return errors.Wrapf(err, "read subtree control of cgroup [%s] failed", root)
+	}
+	enabled := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		enabled[c] = true
+	}
+	for _, c := range controllers {
+		if enabled[c] {
+			continue
+		}
+		file := filepath.Join(root, "cgroup.subtree_control")
+		if err = ioutil.WriteFile(file, []byte("+"+c), 0644); err != nil {
+			return errors.Wrapf(err, "enable %s controller in cgroup [%s] failed", c, root)
+		}
+		enabled[c] = true
+	}
+	return nil
+}
+
+// openCgroup opens the cgroup directory to start the process in it
+func openCgroup(dir string) (*os.File, error) {
+	f, err := os.OpenFile(dir, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	return f, errors.Wrapf(err, "open cgroup [%s] failed", dir)
+}
+
+// removeCgroup removes the cgroup directory if no process is left in it
+func removeCgroup(dir string) error {
+	err := unix.Rmdir(dir)
+	if err == unix.ENOENT || err == unix.EBUSY {
+		return nil
+	}
+	return errors.Wrapf(err, "remove cgroup [%s] failed", dir)
+}
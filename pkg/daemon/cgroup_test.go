@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCgroupRootEnv names a delegated cgroup v2 directory to run cgroup tests in
+const testCgroupRootEnv = "TIPERVISOR_TEST_CGROUP"
+
+func TestCgroup(t *testing.T) {
+	root := os.Getenv(testCgroupRootEnv)
+	if root == "" {
+		t.Skipf("%s is not set", testCgroupRootEnv)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	assert.NoError(t, err)
+	available := strings.Fields(string(data))
+	has := func(c string) bool {
+		for _, a := range available {
+			if a == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	cfg := NewDaemonConfig(t, "test_cgroup")
+	cfg.Cgroup = &CgroupConfig{Root: root}
+	expected := make(map[string]string)
+	if has("memory") {
+		cfg.Cgroup.MemoryMax = 256 << 20
+		cfg.Cgroup.MemoryHigh = 128 << 20
+		expected["memory.max"] = "268435456"
+		expected["memory.high"] = "134217728"
+	}
+	if has("cpu") {
+		cfg.Cgroup.CPUQuota = 50 * time.Millisecond
+		expected["cpu.max"] = "50000 100000"
+	}
+	if has("io") {
+		cfg.Cgroup.IOWeight = 200
+		expected["io.weight"] = "default 200"
+	}
+	if has("pids") {
+		cfg.Cgroup.PidsMax = 64
+		expected["pids.max"] = "64"
+	}
+
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+
+	dir := filepath.Join(root, cfg.Name)
+	for file, value := range expected {
+		data, err = ioutil.ReadFile(filepath.Join(dir, file))
+		assert.NoError(t, err)
+		assert.Equal(t, value, strings.TrimSpace(string(data)), file)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", d.proc.Pid()), strings.TrimSpace(string(data)))
+
+	// the cgroup is removed after supervising
+	cancel()
+	<-d.Done()
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// the cgroup is removed if the config is invalid
+	cfg.LogRedaction = []sink.RedactRule{{Regexp: "("}}
+	_, err = New(cfg, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCgroupCheck(t *testing.T) {
+	lsf := sink.NewDummyLogSinkFactory()
+	cfg := NewDaemonConfig(t, "test_cgroup_check")
+	cfg.Cgroup = &CgroupConfig{Root: os.TempDir()}
+	_, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+
+	cfg = NewDaemonConfig(t, "test_cgroup_check")
+	cfg.Cgroup = &CgroupConfig{}
+	_, err = New(cfg, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+}
@@ -1,7 +1,21 @@
 package daemon
 
 import (
+	"math/rand"
 	"os/user"
+	"syscall"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultInitialBackoff time.Duration  = 1 * time.Second
+	defaultMaxBackoff     time.Duration  = 1 * time.Minute
+	defaultStopSignal     syscall.Signal = syscall.SIGTERM
+	defaultStopTimeout    time.Duration  = 1 * time.Minute
+	defaultLogBufferSize  int            = 4 << 20
 )
 
 // Config maintains the configurations for daemon to run process
@@ -13,7 +27,232 @@ type Config struct {
 	Env       map[string]string
 	User      string
 	StatusDir string
+	// StartSecs is the time the process must stay up after started
+	// to move from STARTING to RUNNING, zero means RUNNING immediately
+	StartSecs time.Duration
+	// AutoRestart decides whether to restart the process exited from RUNNING state,
+	// default is AutoRestartAlways
+	AutoRestart AutoRestart
+	// ExitCodes are the expected exit codes for AutoRestartUnexpected, default is 0
+	ExitCodes      []int
+	Restart        RestartPolicy
+	LivenessProbes []Probe
+	// DependsOn lists the daemons to be started before this one
+	// and stopped after it, only used by Supervisor
+	DependsOn []Dependency
+	// StopSignal is sent to the process group to stop it, default is SIGTERM
+	StopSignal syscall.Signal
+	// StopTimeout is the time to wait for the process to exit after StopSignal,
+	// before killing the process group by SIGKILL, default is 1m
+	StopTimeout time.Duration
+	// StopSequence overrides StopSignal and StopTimeout by an escalation ladder,
+	// e.g. SIGINT, 30s, SIGTERM, 60s, SIGKILL.
+	// SIGKILL is appended if the sequence doesn't end with it.
+	// Every step but the final SIGKILL must have a positive timeout,
+	// otherwise the process is never given a chance to exit by the signal
+	StopSequence []StopStep
+	// Adopt makes the daemon monitor the process recorded in the pid file
+	// if it's still running our command, instead of killing it on startup.
+	// The stdout and stderr of the process are pipes to the previous supervisor,
+	// which break when it exits, so adoption requires the process to log to files,
+	// e.g. by --log-file and LogFiles, or it may be killed by SIGPIPE on writing output
+	Adopt bool
+	// Limits sets the resource limits of the process
+	Limits Limits
+	// Cgroup puts the process into its own cgroup v2 subtree, nil means disabled
+	Cgroup *CgroupConfig
+	// SampleInterval is the period to sample the resource usage
+	// of the process group into RunStat, default is 10s
+	SampleInterval time.Duration
+	// ExitHistorySize is the number of recent runs kept in RunStat.ExitHistory, default is 10
+	ExitHistorySize int
+	// MaxCrashReports is the number of reports kept in StatusDir/<name>/crashes
+	// for the processes exited abnormally, default is 10, negative disables crash reports
+	MaxCrashReports int
+	// CrashLogSize is the max bytes of stdout and stderr each kept in a crash report,
+	// the output is only available if the log sink implements sink.LogTailer, default is 64KB
+	CrashLogSize int
+	// LogOverflow decides what to do with the output when the log buffer is full,
+	// default is sink.DropOldest
+	LogOverflow sink.OverflowPolicy
+	// LogBufferSize is the max bytes of the output buffered for the log sink, default is 4MB
+	LogBufferSize int
+	// LogRedaction masks the secrets in the output before it reaches the log sink,
+	// e.g. sink.DefaultRedactRules, empty means no redaction
+	LogRedaction []sink.RedactRule
+	// LogFiles are the log files written by the process, e.g. the --log-file of TiDB,
+	// relative paths are relative to Cwd. Their new lines are fed to the log sink
+	// tagged with the path, while the daemon is supervising
+	LogFiles []string
+
+	pidfile   string
+	cgroup    string
+	user      *user.User
+	stopSteps []StopStep
+}
+
+// StopStep sends the signal to the process group and waits for the timeout
+// before going to the next step
+type StopStep struct {
+	Signal  syscall.Signal
+	Timeout time.Duration
+}
+
+func checkStopSequence(cfg *Config) error {
+	steps := append([]StopStep(nil), cfg.StopSequence...)
+	if len(steps) == 0 {
+		step := StopStep{
+			Signal:  cfg.StopSignal,
+			Timeout: cfg.StopTimeout,
+		}
+		if step.Signal == 0 {
+			step.Signal = defaultStopSignal
+		}
+		if step.Timeout <= 0 {
+			step.Timeout = defaultStopTimeout
+		}
+		steps = []StopStep{step}
+	}
+	final := len(steps) - 1
+	if steps[final].Signal != syscall.SIGKILL {
+		final = len(steps)
+	}
+	for i, step := range steps {
+		if step.Signal <= 0 {
+			return errors.Errorf("invalid signal [%d] in stop step #%d", step.Signal, i)
+		}
+		if step.Timeout < 0 || (step.Timeout == 0 && i != final) {
+			return errors.Errorf("invalid timeout [%v] in stop step #%d", step.Timeout, i)
+		}
+	}
+	if final == len(steps) {
+		steps = append(steps, StopStep{Signal: syscall.SIGKILL})
+	}
+	cfg.stopSteps = steps
+	return nil
+}
+
+// AutoRestart defines whether to restart a process which exits by itself,
+// a process which exits before being up for StartSecs is always restarted
+type AutoRestart int
+
+// Enum values of the AutoRestart type, borrowed from Supervisord
+const (
+	// AutoRestartAlways restarts the process whatever its exit code is
+	AutoRestartAlways AutoRestart = iota
+	// AutoRestartNever leaves the process in EXITED state
+	AutoRestartNever
+	// AutoRestartUnexpected restarts the process if its exit code is not in ExitCodes
+	AutoRestartUnexpected
+)
+
+func (r AutoRestart) String() string {
+	switch r {
+	case AutoRestartAlways:
+		return "always"
+	case AutoRestartNever:
+		return "never"
+	case AutoRestartUnexpected:
+		return "unexpected"
+	default:
+		return "unknown"
+	}
+}
+
+// shouldRestart returns true if the process exited by itself with the code should be restarted,
+// the code is -1 if the process is killed by a signal or unknown
+func (cfg *Config) shouldRestart(code int) bool {
+	switch cfg.AutoRestart {
+	case AutoRestartNever:
+		return false
+	case AutoRestartUnexpected:
+		return !cfg.isExpectedExit(code)
+	default:
+		return true
+	}
+}
+
+// isExpectedExit returns true if the code is one of ExitCodes
+func (cfg *Config) isExpectedExit(code int) bool {
+	for _, c := range cfg.ExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// DependCondition defines when a dependency is considered satisfied
+type DependCondition int
+
+// Enum values of the DependCondition type
+const (
+	// DependStarted is satisfied when the dependency is in RUNNING state
+	DependStarted DependCondition = iota
+	// DependHealthy is satisfied when the dependency passes all of its liveness probes.
+	// Every probe must have passed once since the process is running, so a probe
+	// with a long InitialDelay or Interval delays the dependents as well
+	DependHealthy
+)
+
+func (c DependCondition) String() string {
+	switch c {
+	case DependStarted:
+		return "STARTED"
+	case DependHealthy:
+		return "HEALTHY"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Dependency describes a daemon which another daemon depends on
+type Dependency struct {
+	Name      string
+	Condition DependCondition
+}
+
+// RestartPolicy controls how the daemon restarts a process which exits unexpectedly
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart, default is 1s
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponentially growing delay, default is 1m.
+	// A process which stays up longer than MaxBackoff resets the backoff
+	MaxBackoff time.Duration
+	// Jitter randomly adds up to the given fraction of the delay, e.g. 0.2 means 20%
+	Jitter float64
+	// MaxRetries is the number of consecutive restarts allowed before
+	// the daemon enters FATAL state, zero means retrying forever
+	MaxRetries int
+}
+
+func (p *RestartPolicy) adjust() {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+}
 
-	pidfile string
-	user    *user.User
+// backoff returns the delay before the given retry counted from zero, the first retry
+// waits InitialBackoff and each next one doubles it up to MaxBackoff, plus the jitter
+func (p *RestartPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
 }
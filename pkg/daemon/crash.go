@@ -0,0 +1,280 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxCrashReports = 10
+	defaultCrashLogSize    = 64 << 10
+	// crashTimeFormat names the report directories, they sort by time
+	crashTimeFormat = "20060102T150405.000000000"
+)
+
+var (
+	// secretPattern matches the names of environment variables and flags holding secrets
+	secretPattern = regexp.MustCompile(`(?i)` + sink.SecretKeyPattern)
+	// crashRedactor masks the other secrets in the values, e.g. the passwords in DSNs
+	crashRedactor = mustNewRedactor(sink.DefaultRedactRules)
+)
+
+func mustNewRedactor(rules []sink.RedactRule) *sink.Redactor {
+	r, err := sink.NewRedactor(rules)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// crashDir returns the directory keeping the crash reports of the daemon
+func (cfg *Config) crashDir() string {
+	return filepath.Join(cfg.StatusDir, cfg.Name, "crashes")
+}
+
+// reportCrash writes the crash report of the exited process in background,
+// so that copying the logs and moving the core file don't delay the restart
+func (d *Daemon) reportCrash(exit ExitRecord) {
+	p, stat := d.proc, d.GetRunningStat()
+	d.crashReports.Add(1)
+	go func() {
+		defer d.crashReports.Done()
+		// one at a time, so that pruning never removes a report being written
+		d.crashMu.Lock()
+		defer d.crashMu.Unlock()
+		if err := d.writeCrashReport(p, exit, stat); err != nil {
+			log.WithField("daemon", d.cfg.Name).Warnf("write crash report failed: %+v", err)
+		}
+	}()
+}
+
+// writeCrashReport writes the details of the abnormal exit to StatusDir/<name>/crashes/<timestamp>/,
+// and removes the oldest reports beyond MaxCrashReports
+func (d *Daemon) writeCrashReport(p *process, exit ExitRecord, stat *RunStat) error {
+	dir := filepath.Join(d.cfg.crashDir(), exit.EndTime.Format(crashTimeFormat))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "create crash report directory failed")
+	}
+
+	if t, ok := p.logSink.(sink.LogTailer); ok {
+		stdout, stderr := t.Tail(d.cfg.CrashLogSize)
+		if err := ioutil.WriteFile(filepath.Join(dir, "stdout.log"), stdout, 0644); err != nil {
+			return errors.Wrap(err, "write crash stdout failed")
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "stderr.log"), stderr, 0644); err != nil {
+			return errors.Wrap(err, "write crash stderr failed")
+		}
+	}
+
+	core := ""
+	if exit.CoreDumped {
+		core = findCoreFile(exit, p.cwd())
+		if core != "" {
+			// move the core file so that it's removed together with the report
+			dst := filepath.Join(dir, filepath.Base(core))
+			if err := os.Rename(core, dst); err == nil {
+				core = dst
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	w := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format+"\n", args...)
+	}
+	w("daemon: %s", d.cfg.Name)
+	w("pid: %d", exit.Pid)
+	w("state: %v", exit.State)
+	w("start time: %s", exit.StartTime.Format(time.RFC3339Nano))
+	w("end time: %s", exit.EndTime.Format(time.RFC3339Nano))
+	w("up time: %v", exit.EndTime.Sub(exit.StartTime))
+	w("exit code: %d", exit.ExitCode)
+	if exit.Signal != 0 {
+		w("signal: %d (%v)", exit.Signal, exit.Signal)
+	}
+	w("core dumped: %v", exit.CoreDumped)
+	if core != "" {
+		w("core file: %s", core)
+	}
+	w("error: %v", exit.Err)
+	w("user time: %v", exit.UserTime)
+	w("sys time: %v", exit.SysTime)
+	w("max rss: %d", exit.MaxRSS)
+
+	w("\n[stat]")
+	w("run count: %d", stat.RunCount)
+	w("stopped count: %d", stat.StoppedCount)
+	w("exited count: %d", stat.ExitedCount)
+	w("killed count: %d", stat.KilledCount)
+	w("exit history:")
+	for _, r := range stat.ExitHistory {
+		w("  %s pid %d exited in %v after %v, code %d, signal %d, error: %v",
+			r.EndTime.Format(time.RFC3339), r.Pid, r.State, r.EndTime.Sub(r.StartTime), r.ExitCode, r.Signal, r.Err)
+	}
+
+	w("\n[command]")
+	w("cmdline: %s", strings.Join(redactArgs(p.cmdline()), " "))
+	w("cwd: %s", p.cwd())
+	w("env:")
+	for _, kv := range redactEnv(p.environ()) {
+		w("  %s", kv)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "report.txt"), buf.Bytes(), 0644); err != nil {
+		return errors.Wrap(err, "write crash report failed")
+	}
+	return pruneCrashReports(d.cfg.crashDir(), d.cfg.MaxCrashReports)
+}
+
+// pruneCrashReports removes the oldest reports to keep at most max ones
+func pruneCrashReports(dir string, max int) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "read crash reports failed")
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-max; i++ {
+		if err = os.RemoveAll(filepath.Join(dir, names[i])); err != nil {
+			return errors.Wrap(err, "remove crash report failed")
+		}
+	}
+	return nil
+}
+
+// cmdline returns the command line of the process as configured
+func (p *process) cmdline() []string {
+	return append([]string{p.Cmd}, p.Args...)
+}
+
+// cwd returns the working directory of the process
+func (p *process) cwd() string {
+	if p.Cwd != "" {
+		return p.Cwd
+	}
+	wd, _ := os.Getwd()
+	return wd
+}
+
+// environ returns the environment of the process, nil if it's adopted
+func (p *process) environ() []string {
+	if p.adopted {
+		return nil
+	}
+	return p.env()
+}
+
+// redactEnv hides the values of the variables whose names look like secrets,
+// and the secrets in the other values by the default redact rules of logs
+func redactEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i >= 0 && secretPattern.MatchString(kv[:i]) {
+			kv = kv[:i+1] + sink.RedactMask
+		} else {
+			kv = string(crashRedactor.Redact([]byte(kv)))
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// redactArgs hides the values of the flags whose names look like secrets,
+// both --name=value and --name value are recognized
+func redactArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	secretNext := false
+	for _, arg := range args {
+		switch {
+		case secretNext && !strings.HasPrefix(arg, "-"):
+			arg = sink.RedactMask
+			secretNext = false
+		case strings.HasPrefix(arg, "-"):
+			secretNext = false
+			if i := strings.IndexByte(arg, '='); i >= 0 {
+				if secretPattern.MatchString(arg[:i]) {
+					arg = arg[:i+1] + sink.RedactMask
+				} else {
+					arg = string(crashRedactor.Redact([]byte(arg)))
+				}
+			} else {
+				secretNext = secretPattern.MatchString(arg)
+			}
+		default:
+			secretNext = false
+			arg = string(crashRedactor.Redact([]byte(arg)))
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// findCoreFile looks for the core file of the exited process by kernel.core_pattern,
+// it returns empty if the core is piped to a program or not found
+func findCoreFile(exit ExitRecord, cwd string) string {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return ""
+	}
+	pattern := strings.TrimSpace(string(data))
+	if pattern == "" || strings.HasPrefix(pattern, "|") {
+		return ""
+	}
+	if !strings.Contains(pattern, "%p") {
+		if data, err = ioutil.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(data)) == "1" {
+			pattern += ".%p"
+		}
+	}
+	// expand the pid and match the other specifiers by wildcard
+	var glob strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			glob.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'p', 'P':
+			glob.WriteString(strconv.Itoa(exit.Pid))
+		case '%':
+			glob.WriteByte('%')
+		default:
+			glob.WriteByte('*')
+		}
+	}
+	path := glob.String()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+	matches, _ := filepath.Glob(path)
+	var (
+		found  string
+		latest time.Time
+	)
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil || !fi.Mode().IsRegular() || fi.ModTime().Before(exit.StartTime) {
+			continue
+		}
+		if fi.ModTime().After(latest) {
+			found, latest = m, fi.ModTime()
+		}
+	}
+	return found
+}
@@ -3,12 +3,9 @@ package daemon
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -24,63 +21,198 @@ import (
 // and supervises the process running
 type Daemon struct {
 	lock, lockOnce uint32
+	// supervising is set once Supervise is called, a daemon is supervised only once
+	supervising    uint32
 	proc           *process
 	state          ProcessState
 	mu             sync.Mutex
 	runch          chan struct{}
 	sigch          chan SignalRequest
+	donech         chan struct{}
+	readyc         chan struct{}
+	readyOnce      sync.Once
 	runStat        *RunStat
 	cfg            *Config
+	lockFile       *os.File
 	logSinkFactory sink.LogSinkFactory
+	logBuffer      *sink.BufferedLogSinkFactory
+	eventSink      sink.EventSink
+	watchers       *watchers
+
+	// retries counts the consecutive restarts after unexpected exits,
+	// retryc fires when the backoff delay is over, both are only
+	// accessed in the supervising goroutine
+	retries    int
+	retryTimer *time.Timer
+	retryc     <-chan time.Time
+	// startc fires when the process has been up for StartSecs,
+	// it's not nil only if the process is alive in STARTING state
+	startTimer *time.Timer
+	startc     <-chan time.Time
+	// adoptPid is the pid of the running process to adopt on first start
+	adoptPid int
+	// probeCancel stops the running liveness probes,
+	// probeOK keeps the last results of them, guarded by mu
+	probeCancel context.CancelFunc
+	probeOK     []bool
+	// sampleCancel stops sampling the resource usage
+	sampleCancel context.CancelFunc
+	// crashReports tracks the crash reports being written in background,
+	// crashMu writes them one at a time
+	crashReports sync.WaitGroup
+	crashMu      sync.Mutex
 }
 
-// New creates a new daemon instance
-func New(cfg *Config, lsf sink.LogSinkFactory) (*Daemon, error) {
-	var err error
-	if err = checkRunning(cfg); err != nil {
+// New creates a new daemon instance, the lifecycle events of the daemon are emitted to the event sink
+func New(cfg *Config, lsf sink.LogSinkFactory, es sink.EventSink) (*Daemon, error) {
+	var (
+		err      error
+		adoptPid int
+		lockFile *os.File
+	)
+	if adoptPid, lockFile, err = checkRunning(cfg); err != nil {
 		return nil, err
 	}
+	defer func() {
+		// release the lock and the cgroup created if the config is invalid
+		if err != nil {
+			if cfg.cgroup != "" {
+				if e := removeCgroup(cfg.cgroup); e != nil {
+					log.WithField("daemon", cfg.Name).Warnf("%+v", e)
+				}
+			}
+			lockFile.Close()
+		}
+	}()
 	if err = checkUser(cfg); err != nil {
 		return nil, err
 	}
+	if err = checkProbes(cfg); err != nil {
+		return nil, err
+	}
+	if err = checkStopSequence(cfg); err != nil {
+		return nil, err
+	}
+	if err = checkLimits(cfg); err != nil {
+		return nil, err
+	}
+	if err = checkCgroup(cfg); err != nil {
+		return nil, err
+	}
+	cfg.Restart.adjust()
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = defaultSampleInterval
+	}
+	if cfg.ExitHistorySize <= 0 {
+		cfg.ExitHistorySize = defaultExitHistorySize
+	}
+	if len(cfg.ExitCodes) == 0 {
+		cfg.ExitCodes = []int{0}
+	}
+	if cfg.MaxCrashReports == 0 {
+		cfg.MaxCrashReports = defaultMaxCrashReports
+	}
+	if cfg.CrashLogSize <= 0 {
+		cfg.CrashLogSize = defaultCrashLogSize
+	}
+	if cfg.LogBufferSize <= 0 {
+		cfg.LogBufferSize = defaultLogBufferSize
+	}
+	if len(cfg.LogRedaction) > 0 {
+		var redactor *sink.Redactor
+		if redactor, err = sink.NewRedactor(cfg.LogRedaction); err != nil {
+			return nil, err
+		}
+		// redact in the goroutine of the buffer instead of the one reading the pipes
+		lsf = sink.NewRedactLogSinkFactory(lsf, redactor)
+	}
+	logBuffer := sink.NewBufferedLogSinkFactory(lsf, sink.BufferConfig{
+		Policy:   cfg.LogOverflow,
+		MaxBytes: cfg.LogBufferSize,
+	})
 	d := &Daemon{
 		state:          ProcStatStopped,
 		runch:          make(chan struct{}, 1),
 		sigch:          make(chan SignalRequest),
+		donech:         make(chan struct{}),
+		readyc:         make(chan struct{}),
 		runStat:        &RunStat{},
 		cfg:            cfg,
-		logSinkFactory: lsf,
+		lockFile:       lockFile,
+		logSinkFactory: logBuffer,
+		logBuffer:      logBuffer,
+		eventSink:      es,
+		watchers:       newWatchers(),
+		adoptPid:       adoptPid,
 	}
 	return d, nil
 }
 
-func checkRunning(cfg *Config) error {
+// checkRunning locks the status of the daemon, and ensures that no process
+// recorded in the pid file is running. It returns the pid of the process
+// to adopt if adoption is enabled, and the locked file
+func checkRunning(cfg *Config) (int, *os.File, error) {
 	if cfg.Name == "" {
-		return errors.New("daemon name can not be empty")
+		return 0, nil, errors.New("daemon name can not be empty")
 	}
 	if cfg.StatusDir == "" {
-		return errors.New("daemon status dir can not be empty")
+		return 0, nil, errors.New("daemon status dir can not be empty")
 	}
 	if !util.IsDir(cfg.StatusDir) {
-		return errors.Errorf("daemon status dir [%s] not exists", cfg.StatusDir)
+		return 0, nil, errors.Errorf("daemon status dir [%s] not exists", cfg.StatusDir)
+	}
+	lockFile, err := lockStatus(cfg)
+	if err != nil {
+		return 0, nil, err
+	}
+	pid, err := checkPidFile(cfg)
+	if err != nil {
+		lockFile.Close()
+		return 0, nil, err
 	}
+	return pid, lockFile, nil
+}
+
+func checkPidFile(cfg *Config) (int, error) {
 	cfg.pidfile = filepath.Join(cfg.StatusDir, fmt.Sprintf("%s.pid", cfg.Name))
-	if util.IsFile(cfg.pidfile) {
-		var (
-			pid int
-			err error
-		)
-		if pid, err = readPidFile(cfg.pidfile); err != nil {
-			return err
-		}
-		// ensure that no process is running
+	if !util.IsFile(cfg.pidfile) {
+		return 0, nil
+	}
+	pid, ticks, err := readPidFile(cfg.pidfile)
+	if err != nil {
+		return 0, err
+	}
+	logger := log.WithField("daemon", cfg.Name)
+	if !isSameProcess(pid, ticks) {
 		if isRunning(pid) {
-			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
-				return errors.Wrapf(err, "sending signal failed")
-			}
+			// the pid is reused by another process, or its start time is unknown
+			logger.Warnf("process [%d] in pid file is not the recorded one, leave it alone", pid)
 		}
+		return 0, nil
+	}
+	if cfg.Adopt {
+		if isAdoptable(cfg, pid) {
+			return pid, nil
+		}
+		logger.Warnf("process [%d] in pid file is not running the configured command, kill it", pid)
+	}
+	// ensure that no process is running
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		return 0, errors.Wrapf(err, "sending signal failed")
+	}
+	return 0, nil
+}
+
+// unlock releases the lock on the status of the daemon
+func (d *Daemon) unlock() {
+	if d.cfg.cgroup != "" {
+		if err := removeCgroup(d.cfg.cgroup); err != nil {
+			log.WithField("daemon", d.cfg.Name).Warnf("%+v", err)
+		}
+	}
+	if err := d.lockFile.Close(); err != nil {
+		log.WithField("daemon", d.cfg.Name).Warnf("release lock failed: %v", err)
 	}
-	return nil
 }
 
 func checkUser(cfg *Config) error {
@@ -99,36 +231,25 @@ func checkUser(cfg *Config) error {
 	return nil
 }
 
-// ReadPidFile read pid from file if error returns pid 0
-func readPidFile(pidfile string) (int, error) {
-	data, err := ioutil.ReadFile(pidfile)
-	if err != nil {
-		return 0, errors.Wrap(err, "read pid file failed")
-	}
-	lines := strings.Split(string(data), "\n")
-	pid, err := strconv.Atoi(lines[0])
-	if err != nil {
-		return 0, errors.Wrap(err, "convert pid failed")
-	}
-	return pid, nil
+// Name returns the daemon name
+func (d *Daemon) Name() string {
+	return d.cfg.Name
 }
 
-func writePidFile(pidfile string, pid int) error {
-	data := []byte(fmt.Sprintf("%d", pid))
-	if err := ioutil.WriteFile(pidfile, data, 0644); err != nil {
-		return errors.Wrapf(err, "write pid file failed")
+// Close releases the status lock and the cgroup of a daemon which is not supervised,
+// a supervised daemon releases them when it stops supervising
+func (d *Daemon) Close() error {
+	if !atomic.CompareAndSwapUint32(&d.supervising, 0, 1) {
+		return errors.Errorf("daemon [%s] is supervised", d.cfg.Name)
 	}
+	d.unlock()
+	close(d.donech)
 	return nil
 }
 
-func isRunning(pid int) bool {
-	// On Unix systems, FindProcess always succeeds and returns a
-	// Process for the given pid, regardless of whether the process exists.
-	proc, _ := os.FindProcess(pid)
-	if err := proc.Signal(syscall.Signal(0)); err != nil {
-		return false
-	}
-	return true
+// Done returns a channel that is closed when the daemon stops supervising
+func (d *Daemon) Done() <-chan struct{} {
+	return d.donech
 }
 
 func (d *Daemon) newProcess() *process {
@@ -140,6 +261,30 @@ func (d *Daemon) newProcess() *process {
 	return p
 }
 
+// startFileTailer follows the log files of the process into a log sink, it returns
+// the function to stop following after the lines written so far are fed
+func (d *Daemon) startFileTailer() func() {
+	if len(d.cfg.LogFiles) == 0 {
+		return func() {}
+	}
+	paths := make([]string, 0, len(d.cfg.LogFiles))
+	for _, path := range d.cfg.LogFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(d.cfg.Cwd, path)
+		}
+		paths = append(paths, path)
+	}
+	s := d.logSinkFactory.NewLogSink()
+	s.Start(nil, nil)
+	// the sinks of the buffer always take lines
+	t := sink.NewFileTailer(paths, s.(sink.LineWriter), 0)
+	t.Start()
+	return func() {
+		t.Stop()
+		s.Stop()
+	}
+}
+
 func (d *Daemon) run() error {
 	var err error
 
@@ -153,86 +298,157 @@ func (d *Daemon) run() error {
 		return err
 	}
 
-	if err = writePidFile(d.cfg.pidfile, p.Pid()); err != nil {
-		if kerr := p.MustKill(); kerr != nil {
+	if err = writePidFile(d.cfg.pidfile, p.Pid(), p.startTicks); err != nil {
+		// the process can't be found by the next supervisor without the pid file,
+		// kill it and handle it as an exit, which is restarted by the policy
+		log.WithField("daemon", d.cfg.Name).Errorf("%+v, kill the process", err)
+		if kerr := p.Kill(); kerr != nil {
 			log.Warnf("%+v", kerr)
 		}
-		return err
 	}
 
 	d.proc = p
-	d.changeToState(ProcStatRunning)
 	d.runStat.Lock()
 	// increase the counter of run times
 	d.runStat.RunCount++
 	d.runStat.StartTime = p.sTime
 	d.runStat.Pid = p.Pid()
 	d.runStat.Unlock()
+	d.emitProcessEvent(sink.EventProcessStarted, nil)
+	d.startSampler(p.Pid())
+
+	if d.cfg.StartSecs > 0 {
+		// keep in STARTING state until the process has been up for StartSecs
+		d.changeToState(ProcStatStarting)
+		d.startTimer = time.NewTimer(d.cfg.StartSecs)
+		d.startc = d.startTimer.C
+	} else {
+		d.changeToState(ProcStatRunning)
+		d.startProbes()
+	}
 
 	return nil
 }
 
 // Supervise supervises the process running,
-// when detects the process exited abnormally, starts it immediately
-func (d *Daemon) Supervise(ctx context.Context) {
+// when detects the process exited abnormally, restarts it according to the restart policy.
+// It returns an error if the daemon is already supervised
+func (d *Daemon) Supervise(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&d.supervising, 0, 1) {
+		return errors.Errorf("daemon [%s] is already supervised", d.cfg.Name)
+	}
 	go func(ctx context.Context) {
+		defer close(d.donech)
+		defer d.unlock()
+		defer d.crashReports.Wait()
+		stopTailer := d.startFileTailer()
+		defer stopTailer()
 		err := d.supervise(ctx)
 		if err != nil {
 			log.WithField("daemon", d.cfg.Name).Errorf("supervise error exit: %+v", err)
 		}
 	}(ctx)
-	// sleep for one second, waiting for process to run up
-	time.Sleep(1 * time.Second)
+	// waiting for the first start attempt to get a result
+	select {
+	case <-d.readyc:
+	case <-d.donech:
+	}
+	return nil
+}
+
+// markReady notifies Supervise that the first start attempt has a result
+func (d *Daemon) markReady() {
+	d.readyOnce.Do(func() {
+		close(d.readyc)
+	})
+}
+
+// starting returns true if the process is alive but not yet up for StartSecs
+func (d *Daemon) starting() bool {
+	return d.startc != nil
+}
+
+// cancelStart stops waiting for the process to be up for StartSecs
+func (d *Daemon) cancelStart() {
+	if d.startc == nil {
+		return
+	}
+	d.startTimer.Stop()
+	d.startc = nil
 }
 
 func (d *Daemon) supervise(ctx context.Context) error {
 	var (
 		err error
 		sig SignalRequest
+		// done is set to nil once the cancellation is handled,
+		// then waiting for the process to exit
+		done = ctx.Done()
 	)
+	defer d.stopProbes()
+	defer d.stopSampler()
 
-	if err = d.run(); err != nil {
+	if d.adoptPid > 0 {
+		err = d.adopt(d.adoptPid)
+		d.adoptPid = 0
+	} else {
+		err = d.run()
+	}
+	if err != nil {
 		// reset lock
 		atomic.StoreUint32(&d.lock, d.lockOnce)
 		return err
 	}
+	if !d.starting() {
+		d.markReady()
+	}
 
 	for {
 		select {
+		case <-d.startc:
+			d.startc = nil
+			if d.ProcessState() == ProcStatStarting {
+				d.changeToState(ProcStatRunning)
+				d.startProbes()
+			}
+			d.markReady()
+		case <-d.retryc:
+			d.retryc = nil
+			if err = d.run(); err != nil {
+				d.startFailed(err)
+			}
 		case <-d.runch:
 			if err = d.run(); err != nil {
-				// reset lock
-				atomic.StoreUint32(&d.lock, d.lockOnce)
-				return err
+				d.startFailed(err)
 			}
 		case sig = <-d.sigch:
 			d.handleSignal(sig)
-		case <-ctx.Done():
+		case <-done:
+			done = nil
 			s := d.ProcessState()
-			switch s {
-			case ProcStatRunning:
+			switch {
+			case s == ProcStatRunning || d.starting():
+				d.cancelStart()
 				d.changeToState(ProcStatTerminating)
 				d.lockOnce = 1
 				err = d.proc.Kill()
-			case ProcStatStopping, ProcStatRestarting, ProcStatKilling:
+			case s == ProcStatStopping || s == ProcStatRestarting || s == ProcStatKilling:
 				d.changeToState(ProcStatTerminating)
 				d.lockOnce = 1
 			default:
 				// exit normally
+				d.cancelRestart()
 				return nil
 			}
 		case perr := <-d.proc.errch:
-			d.runStat.Lock()
-			d.runStat.LastStartTime = d.proc.sTime
-			d.runStat.LastEndTime = d.proc.eTime
-			d.runStat.LastUpTime = d.proc.eTime.Sub(d.proc.sTime)
-			d.runStat.LastUserTime = d.proc.cmd.ProcessState.UserTime()
-			d.runStat.LastSysTime = d.proc.cmd.ProcessState.SystemTime()
-			d.runStat.LastExitErr = perr
-			d.runStat.Pid = 0
-			d.runStat.Unlock()
-
+			d.stopProbes()
+			d.stopSampler()
+			d.cancelStart()
+			d.markReady()
 			s := d.ProcessState()
+			exit := d.recordExit(s, perr)
+			d.emitProcessEvent(sink.EventProcessExited, perr)
+
 			switch s {
 			case ProcStatStopping, ProcStatRestarting:
 				d.changeToState(ProcStatStopped)
@@ -246,7 +462,8 @@ func (d *Daemon) supervise(ctx context.Context) error {
 				d.runStat.KilledCount++
 				d.runStat.LastTerminateState = ProcStatKilled
 				d.runStat.Unlock()
-			case ProcStatRunning:
+			case ProcStatRunning, ProcStatStarting:
+				// exited before being up for StartSecs is a failed start
 				d.changeToState(ProcStatExited)
 				d.runStat.Lock()
 				d.runStat.ExitedCount++
@@ -259,13 +476,80 @@ func (d *Daemon) supervise(ctx context.Context) error {
 				return errors.Errorf("process exit from unexpected state: %v", s)
 			}
 
-			// if lockOnce is not true, the process will be automatically started
-			if d.lockOnce == 0 {
-				d.changeToState(ProcStatStarting)
+			if (s == ProcStatRunning || s == ProcStatStarting) && !d.cfg.isExpectedExit(exit.ExitCode) && d.cfg.MaxCrashReports > 0 {
+				d.reportCrash(exit)
 			}
+
 			// reset lock, if lockOnce is true, the process will not automatically restart next time
 			atomic.StoreUint32(&d.lock, d.lockOnce)
+			if d.lockOnce != 0 {
+				continue
+			}
+			if s == ProcStatRunning && !d.cfg.shouldRestart(exit.ExitCode) {
+				log.WithField("daemon", d.cfg.Name).Infof("process exited with code %d, not restarting by %v policy", exit.ExitCode, d.cfg.AutoRestart)
+				d.retries = 0
+				continue
+			}
+			if s == ProcStatRunning || s == ProcStatStarting {
+				// the process exited unexpectedly, restart it after a backoff delay
+				d.scheduleRestart(s == ProcStatRunning, d.proc.eTime.Sub(d.proc.sTime))
+				continue
+			}
+			// the process is restarted by request, start it immediately
+			d.changeToState(ProcStatStarting)
 			d.runch <- struct{}{}
 		}
 	}
 }
+
+// startFailed handles the process failed to be started, e.g. the command is removed,
+// like a process exiting before RUNNING, it's restarted after the backoff delay
+// or the daemon goes to FATAL after MaxRetries
+func (d *Daemon) startFailed(err error) {
+	log.WithField("daemon", d.cfg.Name).Errorf("%+v", err)
+	// reset lock
+	atomic.StoreUint32(&d.lock, d.lockOnce)
+	d.markReady()
+	d.changeToState(ProcStatExited)
+	d.runStat.Lock()
+	d.runStat.ExitedCount++
+	d.runStat.LastTerminateState = ProcStatExited
+	d.runStat.LastExitErr = err
+	d.runStat.Unlock()
+	if d.lockOnce != 0 {
+		return
+	}
+	d.scheduleRestart(false, 0)
+}
+
+// scheduleRestart arms the backoff timer to restart the process,
+// or moves the daemon to FATAL state if the retries are used up.
+// A failed start which exited before RUNNING is always counted as a retry
+func (d *Daemon) scheduleRestart(started bool, uptime time.Duration) {
+	policy := &d.cfg.Restart
+	if started && uptime >= policy.MaxBackoff {
+		// the process ran long enough, start over the backoff
+		d.retries = 0
+	}
+	if policy.MaxRetries > 0 && d.retries >= policy.MaxRetries {
+		log.WithField("daemon", d.cfg.Name).Errorf("process exited too quickly, gave up after %d retries", d.retries)
+		d.changeToState(ProcStatFatal)
+		return
+	}
+	delay := policy.backoff(d.retries)
+	d.retries++
+	log.WithField("daemon", d.cfg.Name).Infof("process exited unexpectedly, restart it in %v, retry %d", delay, d.retries)
+	d.changeToState(ProcStatStarting)
+	d.retryTimer = time.NewTimer(delay)
+	d.retryc = d.retryTimer.C
+}
+
+// cancelRestart stops the pending restart, returns false if there is none
+func (d *Daemon) cancelRestart() bool {
+	if d.retryc == nil {
+		return false
+	}
+	d.retryTimer.Stop()
+	d.retryc = nil
+	return true
+}
@@ -3,7 +3,12 @@ package daemon
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -12,34 +17,56 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func NewDaemonConfig(name string) *Config {
+func NewDaemonConfig(t *testing.T, name string) *Config {
 	wd, _ := os.Getwd()
 	return &Config{
 		Name:      name,
 		Cmd:       "sleep",
 		Args:      []string{"3600"},
 		Cwd:       wd,
-		StatusDir: os.TempDir(),
+		StatusDir: t.TempDir(),
+	}
+}
+
+// waitForState waits for the daemon to change to the state through the watch channel
+func waitForState(t *testing.T, events <-chan sink.Event, s ProcessState) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("watch channel closed while waiting for state [%v]", s)
+			}
+			if e.Type == sink.EventStateChanged && e.To == s {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("waiting for state [%v] timeout", s)
+		}
 	}
 }
 
 func TestSuperviseRunning(t *testing.T) {
-	cfg := NewDaemonConfig("test_supervise_running")
+	cfg := NewDaemonConfig(t, "test_supervise_running")
 	lsf := sink.NewDummyLogSinkFactory()
-	d, err := New(cfg, lsf)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
 	assert.NoError(t, err)
 	// start to supervise
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	d.Supervise(ctx)
+	assert.NoError(t, d.Supervise(ctx))
 	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	// a daemon is supervised only once
+	assert.Error(t, d.Supervise(ctx))
 	pid := d.proc.Pid()
 	assert.Equal(t, pid, d.GetRunningStat().Pid)
 	assert.True(t, isRunning(pid))
+	events := d.Watch(ctx)
 	// force kill the process
 	assert.NoError(t, syscall.Kill(pid, syscall.SIGKILL))
 	// check
-	time.Sleep(5 * time.Second)
+	waitForState(t, events, ProcStatExited)
+	waitForState(t, events, ProcStatRunning)
 	assert.Equal(t, ProcStatRunning, d.ProcessState())
 	stat := d.GetRunningStat()
 	assert.NotZero(t, stat.LastUpTime)
@@ -49,9 +76,9 @@ func TestSuperviseRunning(t *testing.T) {
 }
 
 func TestManualKill(t *testing.T) {
-	cfg := NewDaemonConfig("test_manual_kill")
+	cfg := NewDaemonConfig(t, "test_manual_kill")
 	lsf := sink.NewDummyLogSinkFactory()
-	d, err := New(cfg, lsf)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
 	assert.NoError(t, err)
 	// start to supervise
 	ctx, cancel := context.WithCancel(context.Background())
@@ -61,10 +88,11 @@ func TestManualKill(t *testing.T) {
 	pid := d.proc.Pid()
 	assert.Equal(t, pid, d.GetRunningStat().Pid)
 	assert.True(t, isRunning(pid))
+	events := d.Watch(ctx)
 	// send KILL signal
 	assert.NoError(t, d.Signal(SignalKill))
 	// check
-	time.Sleep(5 * time.Second)
+	waitForState(t, events, ProcStatKilled)
 	assert.Equal(t, ProcStatKilled, d.ProcessState())
 	stat := d.GetRunningStat()
 	assert.NotZero(t, stat.LastUpTime)
@@ -75,9 +103,9 @@ func TestManualKill(t *testing.T) {
 }
 
 func TestManualStopAndStart(t *testing.T) {
-	cfg := NewDaemonConfig("test_manual_stop_and_start")
+	cfg := NewDaemonConfig(t, "test_manual_stop_and_start")
 	lsf := sink.NewDummyLogSinkFactory()
-	d, err := New(cfg, lsf)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
 	assert.NoError(t, err)
 	// start to supervise
 	ctx, cancel := context.WithCancel(context.Background())
@@ -87,10 +115,11 @@ func TestManualStopAndStart(t *testing.T) {
 	pid := d.proc.Pid()
 	assert.Equal(t, pid, d.GetRunningStat().Pid)
 	assert.True(t, isRunning(pid))
+	events := d.Watch(ctx)
 	// send DOWN signal
 	assert.NoError(t, d.Signal(SignalDown))
 	// check
-	time.Sleep(5 * time.Second)
+	waitForState(t, events, ProcStatStopped)
 	assert.Equal(t, ProcStatStopped, d.ProcessState())
 	stat := d.GetRunningStat()
 	assert.NotZero(t, stat.LastUpTime)
@@ -101,7 +130,7 @@ func TestManualStopAndStart(t *testing.T) {
 	// send UP signal
 	assert.NoError(t, d.Signal(SignalUp))
 	// check
-	time.Sleep(1 * time.Second)
+	waitForState(t, events, ProcStatRunning)
 	assert.Equal(t, ProcStatRunning, d.ProcessState())
 	pid = d.proc.Pid()
 	stat = d.GetRunningStat()
@@ -111,9 +140,9 @@ func TestManualStopAndStart(t *testing.T) {
 }
 
 func TestManualRestart(t *testing.T) {
-	cfg := NewDaemonConfig("test_manual_restart")
+	cfg := NewDaemonConfig(t, "test_manual_restart")
 	lsf := sink.NewDummyLogSinkFactory()
-	d, err := New(cfg, lsf)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
 	assert.NoError(t, err)
 	// start to supervise
 	ctx, cancel := context.WithCancel(context.Background())
@@ -123,10 +152,12 @@ func TestManualRestart(t *testing.T) {
 	pid := d.proc.Pid()
 	assert.Equal(t, pid, d.GetRunningStat().Pid)
 	assert.True(t, isRunning(pid))
+	events := d.Watch(ctx)
 	// send RESTART signal
 	assert.NoError(t, d.Signal(SignalRestart))
 	// check
-	time.Sleep(5 * time.Second)
+	waitForState(t, events, ProcStatStopped)
+	waitForState(t, events, ProcStatRunning)
 	assert.Equal(t, ProcStatRunning, d.ProcessState())
 	stat := d.GetRunningStat()
 	assert.NotZero(t, stat.LastUpTime)
@@ -137,9 +168,14 @@ func TestManualRestart(t *testing.T) {
 }
 
 func TestKillAfterRestart(t *testing.T) {
-	cfg := NewDaemonConfig("test_kill_after_restart")
+	cfg := NewDaemonConfig(t, "test_kill_after_restart")
+	// ignore SIGTERM to keep the process restarting
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "trap '' TERM; exec sleep 3600"}
+	// waiting for the trap to be set
+	cfg.StartSecs = 500 * time.Millisecond
 	lsf := sink.NewDummyLogSinkFactory()
-	d, err := New(cfg, lsf)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
 	assert.NoError(t, err)
 	// start to supervise
 	ctx, cancel := context.WithCancel(context.Background())
@@ -150,22 +186,19 @@ func TestKillAfterRestart(t *testing.T) {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}()
+	events := d.Watch(ctx)
 	d.Supervise(ctx)
 	assert.Equal(t, ProcStatRunning, d.ProcessState())
 	pid := d.proc.Pid()
 	assert.Equal(t, pid, d.GetRunningStat().Pid)
 	assert.True(t, isRunning(pid))
-	// send RESTART signal
+	// send RESTART signal, the process ignores SIGTERM
 	assert.NoError(t, d.Signal(SignalRestart))
-	time.Sleep(1 * time.Second)
 	assert.Equal(t, ProcStatRestarting, d.ProcessState())
-	// send KILL signal immediately
-	// expects to return a "no such process" error
-	_ = d.Signal(SignalKill)
-	time.Sleep(1 * time.Second)
-	assert.Equal(t, ProcStatKilling, d.ProcessState())
+	// send KILL signal
+	assert.NoError(t, d.Signal(SignalKill))
 	// check
-	time.Sleep(3 * time.Second)
+	waitForState(t, events, ProcStatKilled)
 	assert.Equal(t, ProcStatKilled, d.ProcessState())
 	stat := d.GetRunningStat()
 	assert.NotZero(t, stat.LastUpTime)
@@ -174,3 +207,482 @@ func TestKillAfterRestart(t *testing.T) {
 	assert.Equal(t, uint32(1), stat.KilledCount)
 	assert.False(t, isRunning(pid))
 }
+
+func TestRestartBackoff(t *testing.T) {
+	p := &RestartPolicy{
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+	p.adjust()
+	assert.Equal(t, 1*time.Second, p.backoff(0))
+	assert.Equal(t, 2*time.Second, p.backoff(1))
+	assert.Equal(t, 4*time.Second, p.backoff(2))
+	assert.Equal(t, 5*time.Second, p.backoff(3))
+	assert.Equal(t, 5*time.Second, p.backoff(100))
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		delay := p.backoff(1)
+		assert.True(t, delay >= 2*time.Second && delay <= 3*time.Second)
+	}
+}
+
+func TestRestartUntilFatal(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_restart_until_fatal")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "exit 1"}
+	cfg.Restart = RestartPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		MaxRetries:     2,
+	}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	// check
+	waitForState(t, events, ProcStatFatal)
+	assert.Equal(t, ProcStatFatal, d.ProcessState())
+	stat := d.GetRunningStat()
+	assert.Equal(t, ProcStatExited, stat.LastTerminateState)
+	assert.Equal(t, uint32(3), stat.RunCount)
+	assert.Equal(t, uint32(3), stat.ExitedCount)
+	// send UP signal to start over
+	cfg.Args = []string{"3600"}
+	cfg.Cmd = "sleep"
+	assert.NoError(t, d.Signal(SignalUp))
+	waitForState(t, events, ProcStatRunning)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.Equal(t, uint32(4), d.GetRunningStat().RunCount)
+}
+
+func TestRestartExecFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_restart_exec_failed")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile("/bin/sleep")
+	assert.NoError(t, err)
+	cfg := NewDaemonConfig(t, "test_restart_exec_failed")
+	cfg.Cmd = filepath.Join(dir, "sleep")
+	assert.NoError(t, ioutil.WriteFile(cfg.Cmd, data, 0755))
+	cfg.Restart = RestartPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxRetries:     2,
+	}
+	d, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	// the command is removed, the restarts fail to start it
+	assert.NoError(t, os.Remove(cfg.Cmd))
+	assert.NoError(t, d.proc.Signal(syscall.SIGKILL))
+	waitForState(t, events, ProcStatFatal)
+	stat := d.GetRunningStat()
+	assert.Equal(t, uint32(1), stat.RunCount)
+	assert.Equal(t, uint32(3), stat.ExitedCount)
+	assert.Error(t, stat.LastExitErr)
+	// supervising goes on after the failed starts
+	select {
+	case <-d.Done():
+		t.Fatal("supervising exits on failed restarts")
+	default:
+	}
+}
+
+func TestAutoRestart(t *testing.T) {
+	cases := []struct {
+		autoRestart AutoRestart
+		exitCodes   []int
+		script      string
+		restart     bool
+	}{
+		{AutoRestartAlways, nil, "exit 0", true},
+		{AutoRestartNever, nil, "exit 1", false},
+		{AutoRestartUnexpected, nil, "exit 0", false},
+		{AutoRestartUnexpected, nil, "exit 1", true},
+		{AutoRestartUnexpected, []int{0, 2}, "exit 2", false},
+		{AutoRestartUnexpected, []int{0, 2}, "kill -9 $$", true},
+	}
+	for _, c := range cases {
+		cfg := NewDaemonConfig(t, "test_auto_restart")
+		cfg.Cmd = "sh"
+		cfg.Args = []string{"-c", "sleep 0.2; " + c.script}
+		cfg.AutoRestart = c.autoRestart
+		cfg.ExitCodes = c.exitCodes
+		cfg.Restart.InitialBackoff = 100 * time.Millisecond
+		lsf := sink.NewDummyLogSinkFactory()
+		d, err := New(cfg, lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		events := d.Watch(ctx)
+		d.Supervise(ctx)
+		waitForState(t, events, ProcStatExited)
+		if c.restart {
+			waitForState(t, events, ProcStatRunning)
+			assert.Equal(t, uint32(2), d.GetRunningStat().RunCount, "%v %s", c.autoRestart, c.script)
+		} else {
+			assert.Equal(t, ProcStatExited, d.ProcessState(), "%v %s", c.autoRestart, c.script)
+			assert.Equal(t, uint32(1), d.GetRunningStat().RunCount, "%v %s", c.autoRestart, c.script)
+		}
+		cancel()
+		<-d.Done()
+	}
+}
+
+func TestExitHistory(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_exit_history")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "exit 3"}
+	cfg.Restart = RestartPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxRetries:     2,
+	}
+	cfg.ExitHistorySize = 2
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	waitForState(t, events, ProcStatFatal)
+	// only the last two of three runs are kept
+	history := d.GetRunningStat().ExitHistory
+	assert.Len(t, history, 2)
+	for _, r := range history {
+		assert.Equal(t, 3, r.ExitCode)
+		assert.Equal(t, ProcStatRunning, r.State)
+		assert.Zero(t, r.Signal)
+		assert.NotNil(t, r.Rusage)
+		assert.True(t, r.MaxRSS > 0)
+		assert.Error(t, r.Err)
+	}
+	assert.True(t, history[0].EndTime.Before(history[1].StartTime))
+
+	// killed by signal
+	cfg.Args = []string{"3600"}
+	cfg.Cmd = "sleep"
+	assert.NoError(t, d.Signal(SignalUp))
+	waitForState(t, events, ProcStatRunning)
+	assert.NoError(t, d.Signal(SignalKill))
+	waitForState(t, events, ProcStatKilled)
+	history = d.GetRunningStat().ExitHistory
+	assert.Len(t, history, 2)
+	r := history[1]
+	assert.Equal(t, -1, r.ExitCode)
+	assert.Equal(t, ProcStatKilling, r.State)
+	assert.NotZero(t, r.Signal)
+}
+
+func TestStartSecs(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_start_secs")
+	cfg.StartSecs = 1 * time.Second
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise, it returns after the process is up for StartSecs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	d.Supervise(ctx)
+	assert.True(t, time.Since(start) >= cfg.StartSecs)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.Equal(t, uint32(1), d.GetRunningStat().RunCount)
+}
+
+func TestFailedStart(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_failed_start")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "sleep 0.2; exit 1"}
+	cfg.StartSecs = 1 * time.Second
+	cfg.Restart = RestartPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		// the uptime exceeds MaxBackoff, but a failed start is always counted
+		MaxBackoff: 100 * time.Millisecond,
+		MaxRetries: 1,
+	}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise, the process never becomes RUNNING
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.NotEqual(t, ProcStatRunning, d.ProcessState())
+	// check
+	waitForState(t, events, ProcStatFatal)
+	assert.Equal(t, ProcStatFatal, d.ProcessState())
+	stat := d.GetRunningStat()
+	assert.Equal(t, uint32(2), stat.RunCount)
+	assert.Equal(t, uint32(2), stat.ExitedCount)
+}
+
+func TestStopSequence(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_stop_sequence")
+	assert.NoError(t, checkStopSequence(cfg))
+	assert.Equal(t, []StopStep{
+		{Signal: syscall.SIGTERM, Timeout: defaultStopTimeout},
+		{Signal: syscall.SIGKILL},
+	}, cfg.stopSteps)
+	cfg.StopSignal = syscall.SIGINT
+	cfg.StopTimeout = 2 * time.Minute
+	assert.NoError(t, checkStopSequence(cfg))
+	assert.Equal(t, []StopStep{
+		{Signal: syscall.SIGINT, Timeout: 2 * time.Minute},
+		{Signal: syscall.SIGKILL},
+	}, cfg.stopSteps)
+	cfg.StopSequence = []StopStep{
+		{Signal: syscall.SIGINT, Timeout: 30 * time.Second},
+		{Signal: syscall.SIGTERM, Timeout: 60 * time.Second},
+		{Signal: syscall.SIGKILL},
+	}
+	assert.NoError(t, checkStopSequence(cfg))
+	assert.Equal(t, cfg.StopSequence, cfg.stopSteps)
+	cfg.StopSequence = []StopStep{{Signal: syscall.SIGINT, Timeout: -1}}
+	assert.Error(t, checkStopSequence(cfg))
+	// only the final SIGKILL may have no timeout
+	cfg.StopSequence = []StopStep{{Signal: syscall.SIGINT}}
+	assert.Error(t, checkStopSequence(cfg))
+	cfg.StopSequence = []StopStep{
+		{Signal: syscall.SIGINT, Timeout: 30 * time.Second},
+		{Signal: syscall.SIGKILL},
+		{Signal: syscall.SIGKILL},
+	}
+	assert.Error(t, checkStopSequence(cfg))
+}
+
+func TestStopEscalation(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_stop_escalation")
+	// both the shell and its child ignore SIGTERM
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "trap '' TERM; sleep 3600 & wait"}
+	cfg.StartSecs = 500 * time.Millisecond
+	cfg.StopSequence = []StopStep{{Signal: syscall.SIGTERM, Timeout: 1 * time.Second}}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	pid := d.proc.Pid()
+	// send DOWN signal, the process ignores SIGTERM
+	start := time.Now()
+	assert.NoError(t, d.Signal(SignalDown))
+	assert.Equal(t, ProcStatStopping, d.ProcessState())
+	// the whole process group is killed by SIGKILL after timeout
+	waitForState(t, events, ProcStatStopped)
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.False(t, isGroupRunning(pid))
+}
+
+// isGroupRunning returns true if any process which is not a zombie is in the process group
+func isGroupRunning(pgid int) bool {
+	files, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// the fields after the command name: state ppid pgrp ...
+		fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+		if len(fields) > 2 && fields[2] == strconv.Itoa(pgid) && fields[0] != "Z" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStopSignal(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_stop_signal")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "trap '' TERM; exec sleep 3600"}
+	cfg.StartSecs = 500 * time.Millisecond
+	cfg.StopSignal = syscall.SIGINT
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	pid := d.proc.Pid()
+	// send DOWN signal, the process is stopped by SIGINT
+	assert.NoError(t, d.Signal(SignalDown))
+	waitForState(t, events, ProcStatStopped)
+	assert.False(t, isRunning(pid))
+}
+
+func TestKillGroup(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_kill_group")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "sleep 3600 & wait"}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	pid := d.proc.Pid()
+	// send KILL signal, the child is killed as well
+	assert.NoError(t, d.Signal(SignalKill))
+	waitForState(t, events, ProcStatKilled)
+	assert.False(t, isGroupRunning(pid))
+}
+
+type recordEventSink struct {
+	sync.Mutex
+	events []*sink.Event
+}
+
+func (s *recordEventSink) Emit(e *sink.Event) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, e)
+}
+
+func TestEmitEvents(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_emit_events")
+	lsf := sink.NewDummyLogSinkFactory()
+	es := &recordEventSink{}
+	d, err := New(cfg, lsf, es)
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	pid := d.proc.Pid()
+	// send DOWN signal
+	assert.NoError(t, d.Signal(SignalDown))
+	waitForState(t, events, ProcStatStopped)
+	// check
+	es.Lock()
+	defer es.Unlock()
+	expected := []struct {
+		typ      sink.EventType
+		from, to ProcessState
+	}{
+		{sink.EventProcessStarted, ProcStatStopped, ProcStatStopped},
+		{sink.EventStateChanged, ProcStatStopped, ProcStatRunning},
+		{sink.EventStateChanged, ProcStatRunning, ProcStatStopping},
+		{sink.EventProcessExited, ProcStatStopping, ProcStatStopping},
+		{sink.EventStateChanged, ProcStatStopping, ProcStatStopped},
+	}
+	assert.Len(t, es.events, len(expected))
+	for i, e := range es.events {
+		assert.Equal(t, expected[i].typ, e.Type)
+		assert.Equal(t, expected[i].from, e.From)
+		assert.Equal(t, expected[i].to, e.To)
+		assert.Equal(t, cfg.Name, e.Daemon)
+		assert.Equal(t, pid, e.Pid)
+		assert.Equal(t, uint32(1), e.RunCount)
+		assert.False(t, e.Time.IsZero())
+	}
+	assert.Error(t, es.events[3].ExitErr)
+}
+
+// stuckLogSink never returns from WriteLine until released
+type stuckLogSink struct {
+	sink.DummyLogSink
+	releasec chan struct{}
+}
+
+func (s *stuckLogSink) WriteLine(l *sink.Line) {
+	<-s.releasec
+}
+
+func (s *stuckLogSink) NewLogSink() sink.LogSink {
+	return s
+}
+
+func TestLogDropped(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_log_dropped")
+	cfg.Cmd = "seq"
+	cfg.Args = []string{"1000"}
+	cfg.AutoRestart = AutoRestartNever
+	cfg.LogOverflow = sink.DropNewest
+	cfg.LogBufferSize = 100
+	lsf := &stuckLogSink{releasec: make(chan struct{})}
+	defer close(lsf.releasec)
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	waitForState(t, events, ProcStatExited)
+	stat := d.GetRunningStat()
+	assert.True(t, stat.LogDroppedLines > 900)
+	assert.True(t, stat.LogDroppedBytes > stat.LogDroppedLines)
+}
+
+func TestLogRedaction(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_log_redaction")
+	cfg.Cmd = "echo"
+	cfg.Args = []string{"login with password=abc"}
+	cfg.AutoRestart = AutoRestartNever
+	cfg.LogRedaction = []sink.RedactRule{{Regexp: "("}}
+	ring := sink.NewRingLogSinkFactory(sink.RingLogConfig{})
+	_, err := New(cfg, ring, sink.NewDummyEventSink())
+	assert.Error(t, err)
+
+	cfg.LogRedaction = sink.DefaultRedactRules
+	d, err := New(cfg, ring, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	waitForState(t, events, ProcStatExited)
+	lines := ring.Tail(-1)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "login with password=******", string(lines[0].Data))
+}
+
+func TestLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_log_files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := NewDaemonConfig(t, "test_log_files")
+	cfg.Cwd = dir
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "echo started >> app.log; exec sleep 3600"}
+	cfg.LogFiles = []string{"app.log"}
+	ring := sink.NewRingLogSinkFactory(sink.RingLogConfig{})
+	d, err := New(cfg, ring, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := d.Watch(ctx)
+	d.Supervise(ctx)
+	waitForState(t, events, ProcStatRunning)
+	for i := 0; i < 100; i++ {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "app.log")); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-d.Done()
+
+	// the lines written so far are fed before the daemon is done
+	lines := ring.Tail(-1)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "started", string(lines[0].Data))
+	assert.Equal(t, filepath.Join(dir, "app.log"), lines[0].Source)
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ReadPidFile read pid and its start time from file if error returns pid 0,
+// the start time is zero if the pid file doesn't record it
+func readPidFile(pidfile string) (int, uint64, error) {
+	data, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "read pid file failed")
+	}
+	lines := strings.Split(string(data), "\n")
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "convert pid failed")
+	}
+	if len(lines) < 2 || lines[1] == "" {
+		return pid, 0, nil
+	}
+	ticks, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "convert process start time failed")
+	}
+	return pid, ticks, nil
+}
+
+// writePidFile records the pid and its start time in clock ticks after boot,
+// which identifies the process even if the pid is reused
+func writePidFile(pidfile string, pid int, ticks uint64) error {
+	data := []byte(fmt.Sprintf("%d\n%d\n", pid, ticks))
+	if err := ioutil.WriteFile(pidfile, data, 0644); err != nil {
+		return errors.Wrapf(err, "write pid file failed")
+	}
+	return nil
+}
+
+func isRunning(pid int) bool {
+	// On Unix systems, FindProcess always succeeds and returns a
+	// Process for the given pid, regardless of whether the process exists.
+	proc, _ := os.FindProcess(pid)
+	if err := proc.Signal(syscall.Signal(0)); err != nil {
+		return false
+	}
+	return true
+}
+
+// isSameProcess returns true if the process with the pid is running
+// and it started at the given time, a zero start time never matches
+func isSameProcess(pid int, ticks uint64) bool {
+	if ticks == 0 || !isRunning(pid) {
+		return false
+	}
+	t, err := readProcStartTicks(pid)
+	return err == nil && t == ticks
+}
+
+// lockStatus takes an exclusive lock on the lock file of the daemon in status dir,
+// so that only one supervisor manages the daemon with the same name
+func lockStatus(cfg *Config) (*os.File, error) {
+	lockfile := filepath.Join(cfg.StatusDir, fmt.Sprintf("%s.lock", cfg.Name))
+	f, err := os.OpenFile(lockfile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file failed")
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("daemon [%s] is managed by another supervisor", cfg.Name)
+		}
+		return nil, errors.Wrap(err, "lock file failed")
+	}
+	return f, nil
+}
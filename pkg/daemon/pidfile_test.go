@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPidFile(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "test_pid_file.pid")
+	pid := os.Getpid()
+	ticks, err := readProcStartTicks(pid)
+	assert.NoError(t, err)
+	assert.NoError(t, writePidFile(pidfile, pid, ticks))
+	rpid, rticks, err := readPidFile(pidfile)
+	assert.NoError(t, err)
+	assert.Equal(t, pid, rpid)
+	assert.Equal(t, ticks, rticks)
+	assert.True(t, isSameProcess(pid, ticks))
+	assert.False(t, isSameProcess(pid, ticks+1))
+	// the pid file without start time
+	assert.NoError(t, ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d", pid)), 0644))
+	rpid, ticks, err = readPidFile(pidfile)
+	assert.NoError(t, err)
+	assert.Equal(t, pid, rpid)
+	assert.Zero(t, ticks)
+	assert.False(t, isSameProcess(pid, ticks))
+}
+
+func TestReusedPid(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_reused_pid")
+	// the pid in pid file is reused by another process
+	cmd := exec.Command("sleep", "3600")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	ticks, err := readProcStartTicks(pid)
+	assert.NoError(t, err)
+	pidfile := filepath.Join(cfg.StatusDir, cfg.Name+".pid")
+	data := []byte(fmt.Sprintf("%d\n%d\n", pid, ticks-1))
+	assert.NoError(t, ioutil.WriteFile(pidfile, data, 0644))
+	// the process is left alone
+	_, err = New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.True(t, isRunning(pid))
+}
+
+func TestStatusLock(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_status_lock")
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// the daemon is managed by another one
+	other := NewDaemonConfig(t, "test_status_lock")
+	other.StatusDir = cfg.StatusDir
+	_, err = New(other, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+	// the lock is released after supervising
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Supervise(ctx)
+	cancel()
+	<-d.Done()
+	_, err = New(other, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+}
+
+func TestPidFileWriteFailed(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_pid_file_write_failed")
+	// the pid file can't be written to a directory
+	pidfile := filepath.Join(cfg.StatusDir, cfg.Name+".pid")
+	assert.NoError(t, os.MkdirAll(pidfile, 0755))
+	defer os.RemoveAll(pidfile)
+	d, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	assert.NoError(t, d.Supervise(ctx))
+	// the process is killed and restarted instead of stopping supervising
+	waitForState(t, events, ProcStatExited)
+	waitForState(t, events, ProcStatRunning)
+	assert.True(t, d.GetRunningStat().RunCount >= 2)
+}
@@ -0,0 +1,221 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultProbeInterval         time.Duration = 10 * time.Second
+	defaultProbeTimeout          time.Duration = 1 * time.Second
+	defaultProbeFailureThreshold int           = 3
+)
+
+// Probe describes a liveness check performed against the running process,
+// exactly one of HTTPGet, TCPSocket and Exec should be set
+type Probe struct {
+	HTTPGet   *HTTPGetAction
+	TCPSocket *TCPSocketAction
+	Exec      *ExecAction
+	// InitialDelay is the delay after the process is running before the first check
+	InitialDelay time.Duration
+	// Interval is the period between two checks, default is 10s
+	Interval time.Duration
+	// Timeout is the time limit of a single check, default is 1s
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures
+	// to restart the process, default is 3
+	FailureThreshold int
+}
+
+// HTTPGetAction checks the process by an HTTP GET request,
+// a response status code in [200, 400) means success
+type HTTPGetAction struct {
+	URL string
+}
+
+// TCPSocketAction checks the process by connecting to a TCP address
+type TCPSocketAction struct {
+	Address string
+}
+
+// ExecAction checks the process by running a command, exit code zero means success
+type ExecAction struct {
+	Cmd  string
+	Args []string
+}
+
+type prober interface {
+	probe(ctx context.Context) error
+}
+
+func (a *HTTPGetAction) probe(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, a.URL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url [%s]", a.URL)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "http get [%s] failed", a.URL)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("http get [%s] returns unexpected status [%s]", a.URL, resp.Status)
+	}
+	return nil
+}
+
+func (a *TCPSocketAction) probe(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", a.Address)
+	if err != nil {
+		return errors.Wrapf(err, "connect to [%s] failed", a.Address)
+	}
+	conn.Close()
+	return nil
+}
+
+func (a *ExecAction) probe(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, a.Cmd, a.Args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "exec [%s] failed, output: %s", a.Cmd, out)
+	}
+	return nil
+}
+
+func (p *Probe) prober() prober {
+	switch {
+	case p.HTTPGet != nil:
+		return p.HTTPGet
+	case p.TCPSocket != nil:
+		return p.TCPSocket
+	default:
+		return p.Exec
+	}
+}
+
+func checkProbes(cfg *Config) error {
+	for i := range cfg.LivenessProbes {
+		p := &cfg.LivenessProbes[i]
+		n := 0
+		if p.HTTPGet != nil {
+			n++
+		}
+		if p.TCPSocket != nil {
+			n++
+		}
+		if p.Exec != nil {
+			n++
+		}
+		if n != 1 {
+			return errors.Errorf("liveness probe #%d must have exactly one action", i)
+		}
+		if p.Interval <= 0 {
+			p.Interval = defaultProbeInterval
+		}
+		if p.Timeout <= 0 {
+			p.Timeout = defaultProbeTimeout
+		}
+		if p.FailureThreshold <= 0 {
+			p.FailureThreshold = defaultProbeFailureThreshold
+		}
+	}
+	return nil
+}
+
+// startProbes runs the liveness probes against the running process
+func (d *Daemon) startProbes() {
+	d.stopProbes()
+	probes := d.cfg.LivenessProbes
+	pid := d.proc.Pid()
+	d.mu.Lock()
+	d.probeOK = make([]bool, len(probes))
+	d.mu.Unlock()
+	if len(probes) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.probeCancel = cancel
+	for i := range probes {
+		go d.runProbe(ctx, pid, i, &probes[i])
+	}
+}
+
+// stopProbes stops the running liveness probes, it never blocks
+func (d *Daemon) stopProbes() {
+	if d.probeCancel == nil {
+		return
+	}
+	d.probeCancel()
+	d.probeCancel = nil
+}
+
+// runProbe checks the process of the pid, the restart is dropped if the process
+// has been replaced when the probe fails
+func (d *Daemon) runProbe(ctx context.Context, pid int, idx int, p *Probe) {
+	logger := log.WithField("daemon", d.cfg.Name)
+	pr := p.prober()
+	failures := 0
+	wait := p.InitialDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = p.Interval
+
+		pctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		err := pr.probe(pctx)
+		cancel()
+		if ctx.Err() != nil {
+			// the probe is stopped, the result is meaningless
+			return
+		}
+		d.setProbeResult(idx, err == nil)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		logger.Warnf("liveness probe #%d failed %d times: %v", idx, failures, err)
+		if failures >= p.FailureThreshold {
+			logger.Errorf("liveness probe #%d failed %d times, restart the process", idx, failures)
+			if err = d.signalProcess(SignalRestart, pid); err != nil {
+				logger.Warnf("restart process failed: %+v", err)
+			}
+			return
+		}
+	}
+}
+
+func (d *Daemon) setProbeResult(idx int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if idx < len(d.probeOK) {
+		d.probeOK[idx] = ok
+	}
+}
+
+// Healthy returns true if the process is running
+// and all of its liveness probes have passed the last check,
+// it's false until every probe has passed once
+func (d *Daemon) Healthy() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != ProcStatRunning {
+		return false
+	}
+	for _, ok := range d.probeOK {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeActions(t *testing.T) {
+	ctx := context.Background()
+	var status int32 = http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+	httpGet := &HTTPGetAction{URL: ts.URL + "/status"}
+	assert.NoError(t, httpGet.probe(ctx))
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	assert.Error(t, httpGet.probe(ctx))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	tcpSocket := &TCPSocketAction{Address: ln.Addr().String()}
+	assert.NoError(t, tcpSocket.probe(ctx))
+	ln.Close()
+	assert.Error(t, tcpSocket.probe(ctx))
+
+	assert.NoError(t, (&ExecAction{Cmd: "true"}).probe(ctx))
+	assert.Error(t, (&ExecAction{Cmd: "false"}).probe(ctx))
+}
+
+func TestProbeConfig(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_probe_config")
+	cfg.LivenessProbes = []Probe{{}}
+	_, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.Error(t, err)
+	cfg.LivenessProbes = []Probe{{
+		Exec:      &ExecAction{Cmd: "true"},
+		TCPSocket: &TCPSocketAction{Address: "127.0.0.1:1"},
+	}}
+	_, err = New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.Error(t, err)
+	cfg.LivenessProbes = []Probe{{Exec: &ExecAction{Cmd: "true"}}}
+	_, err = New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.Equal(t, defaultProbeInterval, cfg.LivenessProbes[0].Interval)
+	assert.Equal(t, defaultProbeTimeout, cfg.LivenessProbes[0].Timeout)
+	assert.Equal(t, defaultProbeFailureThreshold, cfg.LivenessProbes[0].FailureThreshold)
+}
+
+func TestProbeRestart(t *testing.T) {
+	// failures is the number of requests to fail
+	var failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	cfg := NewDaemonConfig(t, "test_probe_restart")
+	cfg.LivenessProbes = []Probe{{
+		HTTPGet:          &HTTPGetAction{URL: ts.URL + "/status"},
+		Interval:         100 * time.Millisecond,
+		FailureThreshold: 3,
+	}}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.Supervise(ctx)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.True(t, d.Healthy())
+	pid := d.proc.Pid()
+	// make the probe fail 3 times
+	atomic.StoreInt32(&failures, 3)
+	// check
+	time.Sleep(1 * time.Second)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	stat := d.GetRunningStat()
+	assert.Equal(t, ProcStatStopped, stat.LastTerminateState)
+	assert.Equal(t, uint32(2), stat.RunCount)
+	assert.False(t, isRunning(pid))
+	assert.True(t, d.Healthy())
+	// the restart for the old process doesn't affect the new one
+	assert.Error(t, d.signalProcess(SignalRestart, pid))
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+	assert.Equal(t, uint32(2), d.GetRunningStat().RunCount)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"syscall"
 	"time"
@@ -13,8 +14,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-const minRunningDuration time.Duration = 5 * time.Second
-
 // Process defines operations with process
 type Process interface {
 	Pid() int
@@ -29,8 +28,15 @@ type process struct {
 	*Config
 	logSink sink.LogSink
 
-	cmd          *exec.Cmd
+	cmd *exec.Cmd
+	pid int
+	// adopted is true if the process is not started by us, cmd is nil then
+	adopted bool
+	// startTicks is the start time of the process in clock ticks after boot,
+	// it's read before the process can be reaped
+	startTicks   uint64
 	errch        chan error
+	exitch       chan struct{}
 	sTime, eTime time.Time
 }
 
@@ -43,11 +49,7 @@ func (p *process) Start() error {
 	}
 
 	if p.Env != nil {
-		env := os.Environ()
-		for k, v := range p.Env {
-			env = append(env, fmt.Sprintf("%s=%s", k, v))
-		}
-		p.cmd.Env = env
+		p.cmd.Env = p.env()
 	}
 
 	sysProcAttr := new(syscall.SysProcAttr)
@@ -69,6 +71,16 @@ func (p *process) Start() error {
 
 	sysProcAttr.Setpgid = true
 	sysProcAttr.Pgid = 0
+	if p.cgroup != "" {
+		// start the process in the cgroup, so that its children never escape
+		cg, err := openCgroup(p.cgroup)
+		if err != nil {
+			return err
+		}
+		defer cg.Close()
+		sysProcAttr.UseCgroupFD = true
+		sysProcAttr.CgroupFD = int(cg.Fd())
+	}
 	p.cmd.SysProcAttr = sysProcAttr
 
 	var (
@@ -93,22 +105,41 @@ func (p *process) Start() error {
 		p.logSink.Start(prOut, prErr)
 	}
 
-	if err := p.cmd.Start(); err != nil {
+	err := p.cmd.Start()
+	if limits := p.Limits.list(); err == nil && len(limits) > 0 {
+		if err = applyLimits(p.cmd.Process.Pid, limits); err != nil {
+			_ = p.cmd.Process.Kill()
+			_ = p.cmd.Wait()
+		}
+	}
+	if p.logSink != nil {
+		// the child has its own copies, close ours so that
+		// the log sink reads EOF after the process exits
+		pwOut.Close()
+		pwErr.Close()
+	}
+	if err != nil {
+		if p.logSink != nil {
+			p.logSink.Stop()
+		}
 		return errors.Wrap(err, "start process failed")
 	}
+	// the process is not reaped until the Wait below, so its stat is always readable
+	if ticks, err := readProcStartTicks(p.cmd.Process.Pid); err == nil {
+		p.startTicks = ticks
+	} else {
+		log.Warnf("read start time of process [%d] failed: %v", p.cmd.Process.Pid, err)
+	}
 
+	p.pid = p.cmd.Process.Pid
 	p.sTime = time.Now()
 	p.errch = make(chan error, 1)
+	p.exitch = make(chan struct{})
 
 	go func() {
 		err := p.cmd.Wait()
 		p.eTime = time.Now()
-		// prevent the process from being restarted repeatedly
-		uptime := p.eTime.Sub(p.sTime)
-		if uptime < minRunningDuration {
-			wait := minRunningDuration - uptime
-			time.Sleep(wait)
-		}
+		close(p.exitch)
 		// stop log sink
 		if p.logSink != nil {
 			p.logSink.Stop()
@@ -120,6 +151,21 @@ func (p *process) Start() error {
 	return nil
 }
 
+// env returns the environment of the process, the variables of
+// the config are appended to the ones of the supervisor
+func (p *process) env() []string {
+	keys := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := os.Environ()
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, p.Env[k]))
+	}
+	return env
+}
+
 // Wait is waiting for process to end, and return its exit code
 // return nil if exit code is zero
 func (p *process) Wait() error {
@@ -132,40 +178,63 @@ func (p *process) Wait() error {
 
 // Pid return process pid
 func (p *process) Pid() int {
-	if p.cmd == nil || p.cmd.Process == nil {
-		return 0
+	return p.pid
+}
+
+// state returns the exit state of the process, nil if it's adopted or not exited
+func (p *process) state() *os.ProcessState {
+	if p.cmd == nil {
+		return nil
 	}
-	return p.cmd.Process.Pid
+	return p.cmd.ProcessState
 }
 
 // Signal sends a signal to the process
 func (p *process) Signal(sig syscall.Signal) error {
-	err := syscall.Kill(p.cmd.Process.Pid, sig)
+	err := syscall.Kill(p.pid, sig)
 	return errors.Wrapf(err, "sending signal failed")
 }
 
-// Kill the entire process group
+// signalGroup sends a signal to the entire process group
+func (p *process) signalGroup(sig syscall.Signal) error {
+	processGroup := 0 - p.pid
+	err := syscall.Kill(processGroup, sig)
+	return errors.Wrapf(err, "sending signal [%v] to process group failed", sig)
+}
+
+// Kill the entire process group by the stop sequence, it sends the first signal
+// and escalates to the next ones in background if the process doesn't exit in time
 func (p *process) Kill() error {
-	processGroup := 0 - p.cmd.Process.Pid
-	err := syscall.Kill(processGroup, syscall.SIGTERM)
-	return errors.Wrap(err, "killing process failed")
+	steps := p.stopSteps
+	if err := p.signalGroup(steps[0].Signal); err != nil {
+		return errors.Wrap(err, "killing process failed")
+	}
+	go p.escalate(steps)
+	return nil
+}
+
+func (p *process) escalate(steps []StopStep) {
+	for i := 1; i < len(steps); i++ {
+		timer := time.NewTimer(steps[i-1].Timeout)
+		select {
+		case <-p.exitch:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		log.Warnf("stop process [%d] waiting timeout %v, try to send signal [%v]", p.Pid(), steps[i-1].Timeout, steps[i].Signal)
+		if err := p.signalGroup(steps[i].Signal); err != nil {
+			log.Warnf("%+v", err)
+		}
+	}
 }
 
-// MustKill try to kill the process and wait for it to die in a timeout period
+// MustKill kills the process by the stop sequence and waits for it to exit
 func (p *process) MustKill() error {
 	if err := p.Kill(); err != nil {
 		return err
 	}
-	select {
-	case <-p.errch:
-		// exited
-	case <-time.After(1 * time.Minute):
-		log.Warnf("kill process [%d] waiting timeout, try to send a kill -9 signal", p.Pid())
-		if err := p.Signal(syscall.SIGKILL); err != nil {
-			return errors.Wrap(err, "killing process -9 failed")
-		}
-		// make sure process exited
-		<-p.errch
-	}
+	// the sequence always ends with SIGKILL, make sure process exited
+	<-p.exitch
 	return nil
 }
@@ -1,5 +1,11 @@
 package daemon
 
+import (
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+)
+
 // ProcessState defines the process running state
 type ProcessState int
 
@@ -54,9 +60,43 @@ func (s ProcessState) String() string {
 
 func (d *Daemon) changeToState(s ProcessState) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	from := d.state
 	d.state = s
-	// todo: emit an event here
+	d.mu.Unlock()
+	if from == s {
+		return
+	}
+	d.emit(&sink.Event{
+		Type: sink.EventStateChanged,
+		From: from,
+		To:   s,
+	})
+}
+
+// emitProcessEvent emits a process started or exited event
+func (d *Daemon) emitProcessEvent(t sink.EventType, exitErr error) {
+	s := d.ProcessState()
+	d.emit(&sink.Event{
+		Type:    t,
+		From:    s,
+		To:      s,
+		ExitErr: exitErr,
+	})
+}
+
+// emit fills the common fields of the event and sends it to the event sink,
+// it's only called in the supervising goroutine
+func (d *Daemon) emit(e *sink.Event) {
+	e.Daemon = d.cfg.Name
+	e.Time = time.Now()
+	if d.proc != nil {
+		e.Pid = d.proc.Pid()
+	}
+	d.runStat.RLock()
+	e.RunCount = d.runStat.RunCount
+	d.runStat.RUnlock()
+	d.eventSink.Emit(e)
+	d.watchers.publish(*e)
 }
 
 // ProcessState returns the current process state
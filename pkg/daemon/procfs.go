@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is the number of clock ticks per second used by /proc, USER_HZ is 100 on Linux
+const clockTicks = 100
+
+// readProcCmdline returns the command line arguments of the process
+func readProcCmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, errors.Wrap(err, "read process cmdline failed")
+	}
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// readProcStat returns the fields of /proc/<pid>/stat after the command name,
+// so that the process state is the first one
+func readProcStat(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, errors.Wrap(err, "read process stat failed")
+	}
+	// the command name may contain spaces and parentheses
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil, errors.Errorf("invalid process stat [%s]", data)
+	}
+	return strings.Fields(string(data[i+1:])), nil
+}
+
+// readProcStartTicks returns the start time of the process in clock ticks after boot
+func readProcStartTicks(pid int) (uint64, error) {
+	fields, err := readProcStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	// starttime is the 22nd field of stat, the 20th after the command name
+	if len(fields) < 20 {
+		return 0, errors.Errorf("invalid process stat of pid [%d]", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	return ticks, errors.Wrap(err, "parse process start time failed")
+}
+
+// readBootTime returns the system boot time
+func readBootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "read system stat failed")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "btime ") {
+			continue
+		}
+		sec, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "parse boot time failed")
+		}
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, errors.New("boot time not found")
+}
+
+// readProcStartTime returns the wall clock start time of the process,
+// the precision is one second limited by the boot time
+func readProcStartTime(pid int) (time.Time, error) {
+	ticks, err := readProcStartTicks(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	btime, err := readBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return btime.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// isExited returns true if the process doesn't exist,
+// or it has exited but not been reaped yet
+func isExited(pid int) bool {
+	fields, err := readProcStat(pid)
+	if err != nil || len(fields) == 0 {
+		return true
+	}
+	return fields[0] == "Z" || fields[0] == "X"
+}
+
+// procUsage is the resource usage of a single process
+type procUsage struct {
+	cpuTicks   uint64
+	rss        uint64
+	threads    int
+	fds        int
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// listProcGroup returns the pids of the live processes in the process group
+func listProcGroup(pgid int) ([]int, error) {
+	names, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "read /proc failed")
+	}
+	var pids []int
+	for _, fi := range names {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		fields, err := readProcStat(pid)
+		// pgrp is the 5th field of stat, the 3rd after the command name
+		if err != nil || len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if fields[2] == strconv.Itoa(pgid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// readProcUsage reads the resource usage of the process from stat, status, io and fd,
+// io is skipped if it's not permitted to read
+func readProcUsage(pid int) (*procUsage, error) {
+	fields, err := readProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	// utime and stime are the 14th and 15th fields of stat
+	if len(fields) < 13 {
+		return nil, errors.Errorf("invalid process stat of pid [%d]", pid)
+	}
+	u := &procUsage{}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	u.cpuTicks = utime + stime
+
+	status, err := readProcKeyValues(pid, "status")
+	if err != nil {
+		return nil, err
+	}
+	// VmRSS is in kB
+	rss, _ := strconv.ParseUint(strings.TrimSuffix(status["VmRSS"], " kB"), 10, 64)
+	u.rss = rss << 10
+	u.threads, _ = strconv.Atoi(status["Threads"])
+
+	fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return nil, errors.Wrap(err, "read process fd failed")
+	}
+	u.fds = len(fds)
+
+	if io, err := readProcKeyValues(pid, "io"); err == nil {
+		u.readBytes, _ = strconv.ParseUint(io["read_bytes"], 10, 64)
+		u.writeBytes, _ = strconv.ParseUint(io["write_bytes"], 10, 64)
+	}
+	return u, nil
+}
+
+// readProcKeyValues reads a /proc/<pid>/<name> file of "key: value" lines
+func readProcKeyValues(pid int, name string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/%s", pid, name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read process %s failed", name)
+	}
+	kvs := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		kvs[line[:i]] = strings.TrimSpace(line[i+1:])
+	}
+	return kvs, nil
+}
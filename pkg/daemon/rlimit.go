@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// RlimInfinity means no limit on the resource
+const RlimInfinity = unix.RLIM_INFINITY
+
+// capSysResource is the capability to raise hard resource limits
+const capSysResource = 24
+
+// Rlimit is the soft and hard limit of a resource
+type Rlimit struct {
+	Soft uint64
+	Hard uint64
+}
+
+// Limits sets the resource limits of the process, a nil limit is inherited from the supervisor.
+// The limits are set by prlimit(2) right after the process is started, so the command may
+// run a few instructions with the inherited ones, e.g. the stack of the main thread is
+// already set up by then. Raising a hard limit above the supervisor's one, or setting
+// the limits of a process running as another user requires CAP_SYS_RESOURCE
+type Limits struct {
+	// NoFile is the max number of open files, RLIMIT_NOFILE
+	NoFile *Rlimit
+	// NProc is the max number of processes of the user, RLIMIT_NPROC
+	NProc *Rlimit
+	// Core is the max size of core dump in bytes, RLIMIT_CORE
+	Core *Rlimit
+	// Stack is the max size of stack in bytes, RLIMIT_STACK
+	Stack *Rlimit
+	// MemLock is the max size of locked memory in bytes, RLIMIT_MEMLOCK
+	MemLock *Rlimit
+	// AS is the max size of virtual memory in bytes, RLIMIT_AS
+	AS *Rlimit
+}
+
+type rlimit struct {
+	name     string
+	resource int
+	*Rlimit
+}
+
+// list returns the limits which are set
+func (l *Limits) list() []rlimit {
+	all := []rlimit{
+		{"RLIMIT_NOFILE", unix.RLIMIT_NOFILE, l.NoFile},
+		{"RLIMIT_NPROC", unix.RLIMIT_NPROC, l.NProc},
+		{"RLIMIT_CORE", unix.RLIMIT_CORE, l.Core},
+		{"RLIMIT_STACK", unix.RLIMIT_STACK, l.Stack},
+		{"RLIMIT_MEMLOCK", unix.RLIMIT_MEMLOCK, l.MemLock},
+		{"RLIMIT_AS", unix.RLIMIT_AS, l.AS},
+	}
+	var limits []rlimit
+	for _, r := range all {
+		if r.Rlimit != nil {
+			limits = append(limits, r)
+		}
+	}
+	return limits
+}
+
+func checkLimits(cfg *Config) error {
+	limits := cfg.Limits.list()
+	if len(limits) > 0 && cfg.user != nil && cfg.user.Uid != strconv.Itoa(os.Getuid()) && !hasCapability(capSysResource) {
+		return errors.Errorf("can't set limits of the process running as user [%s] without CAP_SYS_RESOURCE", cfg.User)
+	}
+	for _, r := range limits {
+		if r.Soft > r.Hard {
+			return errors.Errorf("soft limit [%d] of %s is greater than hard limit [%d]", r.Soft, r.name, r.Hard)
+		}
+		var cur unix.Rlimit
+		if err := unix.Getrlimit(r.resource, &cur); err != nil {
+			return errors.Wrapf(err, "get %s failed", r.name)
+		}
+		if r.Hard > cur.Max && !hasCapability(capSysResource) {
+			return errors.Errorf("can't raise hard limit of %s from [%d] to [%d] without CAP_SYS_RESOURCE", r.name, cur.Max, r.Hard)
+		}
+		if r.resource == unix.RLIMIT_NOFILE {
+			nrOpen, err := readNrOpen()
+			if err != nil {
+				return err
+			}
+			if r.Hard > nrOpen {
+				return errors.Errorf("hard limit [%d] of %s exceeds fs.nr_open [%d]", r.Hard, r.name, nrOpen)
+			}
+		}
+	}
+	return nil
+}
+
+// hasCapability returns true if the supervisor has the effective capability
+func hasCapability(c uint) bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		return err == nil && caps&(1<<c) != 0
+	}
+	return false
+}
+
+// readNrOpen returns the max number of open files a process can be allowed
+func readNrOpen() (uint64, error) {
+	data, err := ioutil.ReadFile("/proc/sys/fs/nr_open")
+	if err != nil {
+		return 0, errors.Wrap(err, "read fs.nr_open failed")
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n, errors.Wrap(err, "parse fs.nr_open failed")
+}
+
+// applyLimits sets the limits of the started process
+func applyLimits(pid int, limits []rlimit) error {
+	for _, r := range limits {
+		lim := unix.Rlimit{Cur: r.Soft, Max: r.Hard}
+		if err := unix.Prlimit(pid, r.resource, &lim, nil); err != nil {
+			return errors.Wrapf(err, "set %s of process [%d] failed", r.name, pid)
+		}
+	}
+	return nil
+}
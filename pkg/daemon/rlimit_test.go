@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"testing"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestLimits(t *testing.T) {
+	var core, stack unix.Rlimit
+	assert.NoError(t, unix.Getrlimit(unix.RLIMIT_CORE, &core))
+	assert.NoError(t, unix.Getrlimit(unix.RLIMIT_STACK, &stack))
+	cfg := NewDaemonConfig(t, "test_limits")
+	cfg.Limits = Limits{
+		NoFile: &Rlimit{Soft: 512, Hard: 1024},
+		Core:   &Rlimit{Soft: core.Max, Hard: core.Max},
+		Stack:  &Rlimit{Soft: 16 << 20, Hard: stack.Max},
+	}
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-d.Done()
+	}()
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+
+	var lim unix.Rlimit
+	pid := d.proc.Pid()
+	assert.NoError(t, unix.Prlimit(pid, unix.RLIMIT_NOFILE, nil, &lim))
+	assert.Equal(t, unix.Rlimit{Cur: 512, Max: 1024}, lim)
+	assert.NoError(t, unix.Prlimit(pid, unix.RLIMIT_CORE, nil, &lim))
+	assert.Equal(t, unix.Rlimit{Cur: core.Max, Max: core.Max}, lim)
+	assert.NoError(t, unix.Prlimit(pid, unix.RLIMIT_STACK, nil, &lim))
+	assert.Equal(t, unix.Rlimit{Cur: 16 << 20, Max: stack.Max}, lim)
+	// the command is started as it is
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	assert.NoError(t, err)
+	assert.Equal(t, "sleep\x003600\x00", string(cmdline))
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(environ), "TIPERVISOR_")
+}
+
+func TestLimitsWithUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	usr, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("user nobody not exists")
+	}
+	cfg := NewDaemonConfig(t, "test_limits_with_user")
+	cfg.User = usr.Username
+	cfg.Limits.NoFile = &Rlimit{Soft: 512, Hard: 1024}
+	d, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	if !hasCapability(capSysResource) {
+		// the limits of the process of another user can't be set
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "CAP_SYS_RESOURCE")
+		return
+	}
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-d.Done()
+	}()
+	d.Supervise(ctx)
+	assert.Equal(t, ProcStatRunning, d.ProcessState())
+
+	var lim unix.Rlimit
+	pid := d.proc.Pid()
+	assert.NoError(t, unix.Prlimit(pid, unix.RLIMIT_NOFILE, nil, &lim))
+	assert.Equal(t, unix.Rlimit{Cur: 512, Max: 1024}, lim)
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	assert.NoError(t, err)
+	assert.Contains(t, string(status), fmt.Sprintf("Uid:\t%s\t", usr.Uid))
+}
+
+func TestLimitsExecFailed(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_limits_exec_failed")
+	cfg.Cmd = "/nonexistent/command"
+	cfg.Limits.NoFile = &Rlimit{Soft: 512, Hard: 1024}
+	d, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	// the process isn't started, no limit is set
+	err = d.newProcess().Start()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/nonexistent/command")
+}
+
+func TestLimitsCheck(t *testing.T) {
+	lsf := sink.NewDummyLogSinkFactory()
+	cfg := NewDaemonConfig(t, "test_limits_check")
+	cfg.Limits.Stack = &Rlimit{Soft: 2 << 20, Hard: 1 << 20}
+	_, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+
+	nrOpen, err := readNrOpen()
+	assert.NoError(t, err)
+	cfg = NewDaemonConfig(t, "test_limits_check")
+	cfg.Limits.NoFile = &Rlimit{Soft: 1024, Hard: nrOpen + 1}
+	_, err = New(cfg, lsf, sink.NewDummyEventSink())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "RLIMIT_NOFILE")
+
+	if !hasCapability(capSysResource) {
+		var cur unix.Rlimit
+		assert.NoError(t, unix.Getrlimit(unix.RLIMIT_MEMLOCK, &cur))
+		if cur.Max != RlimInfinity {
+			cfg = NewDaemonConfig(t, "test_limits_check")
+			cfg.Limits.MemLock = &Rlimit{Soft: cur.Max + 1, Hard: cur.Max + 1}
+			_, err = New(cfg, lsf, sink.NewDummyEventSink())
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "CAP_SYS_RESOURCE")
+		}
+	}
+}
@@ -70,15 +70,28 @@ func (s Signal) String() string {
 // SignalRequest includes the specific signal value and a response channel to send back result
 type SignalRequest struct {
 	signal Signal
-	respc  chan error
+	// pid is the process the signal is meant for, zero means the current one
+	pid   int
+	respc chan error
 }
 
 // Signal sends a given signal, and waiting for the daemon return
 func (d *Daemon) Signal(s Signal) error {
+	return d.signalProcess(s, 0)
+}
+
+// signalProcess is like Signal, but the signal is dropped
+// if the process is not the current one any more, e.g. it has been restarted
+func (d *Daemon) signalProcess(s Signal, pid int) error {
 	rc := make(chan error, 1)
-	d.sigch <- SignalRequest{
+	select {
+	case d.sigch <- SignalRequest{
 		signal: s,
+		pid:    pid,
 		respc:  rc,
+	}:
+	case <-d.donech:
+		return errors.Errorf("daemon [%s] is not supervising, drop signal [%v]", d.cfg.Name, s)
 	}
 	select {
 	case err := <-rc:
@@ -94,6 +107,10 @@ func (d *Daemon) Signal(s Signal) error {
 func (d *Daemon) handleSignal(r SignalRequest) {
 	var err error
 
+	if r.pid != 0 && (d.proc == nil || d.proc.Pid() != r.pid) {
+		r.respc <- errors.Errorf("process [%d] is not running, drop signal [%v]", r.pid, r.signal)
+		return
+	}
 	switch r.signal {
 	case SignalAlrm:
 		err = d.proc.Signal(syscall.SIGALRM)
@@ -101,11 +118,17 @@ func (d *Daemon) handleSignal(r SignalRequest) {
 		err = d.proc.Signal(syscall.SIGCONT)
 	case SignalDown:
 		s := d.ProcessState()
-		switch s {
-		case ProcStatRunning:
+		switch {
+		case s == ProcStatRunning || d.starting():
+			d.cancelStart()
 			d.changeToState(ProcStatStopping)
 			d.lockOnce = 1
 			err = d.proc.Kill()
+		case s == ProcStatStarting && d.cancelRestart():
+			// the restart waiting for backoff is canceled
+			d.changeToState(ProcStatStopped)
+			d.lockOnce = 1
+			atomic.StoreUint32(&d.lock, d.lockOnce)
 		default:
 			err = errors.Errorf("can't stop process from state [%v]", s)
 		}
@@ -113,8 +136,9 @@ func (d *Daemon) handleSignal(r SignalRequest) {
 		err = d.proc.Signal(syscall.SIGHUP)
 	case SignalRestart:
 		s := d.ProcessState()
-		switch s {
-		case ProcStatRunning:
+		switch {
+		case s == ProcStatRunning || d.starting():
+			d.cancelStart()
 			d.changeToState(ProcStatRestarting)
 			d.lockOnce = 0
 			err = d.proc.Kill()
@@ -127,11 +151,12 @@ func (d *Daemon) handleSignal(r SignalRequest) {
 		err = d.proc.Signal(syscall.SIGTTIN)
 	case SignalKill:
 		s := d.ProcessState()
-		switch s {
-		case ProcStatRunning, ProcStatStopping, ProcStatRestarting:
+		switch {
+		case s == ProcStatRunning || s == ProcStatStopping || s == ProcStatRestarting || d.starting():
+			d.cancelStart()
 			d.changeToState(ProcStatKilling)
 			d.lockOnce = 1
-			err = d.proc.Signal(syscall.SIGKILL)
+			err = d.proc.signalGroup(syscall.SIGKILL)
 		default:
 			err = errors.Errorf("can't kill process from state [%v]", s)
 		}
@@ -144,8 +169,9 @@ func (d *Daemon) handleSignal(r SignalRequest) {
 	case SignalUp:
 		s := d.ProcessState()
 		switch s {
-		case ProcStatStopped, ProcStatKilled, ProcStatExited:
+		case ProcStatStopped, ProcStatKilled, ProcStatExited, ProcStatFatal:
 			d.changeToState(ProcStatStarting)
+			d.retries = 0
 			d.lockOnce = 0
 			atomic.StoreUint32(&d.lock, d.lockOnce)
 			d.runch <- struct{}{}
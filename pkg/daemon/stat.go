@@ -2,9 +2,12 @@ package daemon
 
 import (
 	"sync"
+	"syscall"
 	"time"
 )
 
+const defaultExitHistorySize = 10
+
 // RunStat keeps the statistics of the running process
 type RunStat struct {
 	sync.RWMutex
@@ -21,12 +24,109 @@ type RunStat struct {
 	ExitedCount        uint32
 	KilledCount        uint32
 	Pid                int
+	// Usage is the latest resource usage of the running process group
+	Usage ResourceUsage
+	// ExitHistory keeps the details of the recent runs, the oldest first
+	ExitHistory []ExitRecord
+	// LogDroppedLines and LogDroppedBytes count the output dropped
+	// since the log buffer is full, see Config.LogOverflow
+	LogDroppedLines uint64
+	LogDroppedBytes uint64
+}
+
+// ExitRecord describes how a run of the process ended
+type ExitRecord struct {
+	Pid       int
+	StartTime time.Time
+	EndTime   time.Time
+	// State is the daemon state when the process exited,
+	// e.g. RUNNING means it exited unexpectedly and STOPPING means it's stopped by request
+	State ProcessState
+	// ExitCode is the exit status, -1 if the process is killed by a signal or adopted
+	ExitCode int
+	// Signal is the signal terminating the process, zero if it exited by itself
+	Signal     syscall.Signal
+	CoreDumped bool
+	UserTime   time.Duration
+	SysTime    time.Duration
+	// MaxRSS is the max resident memory in bytes
+	MaxRSS int64
+	// Rusage is the resource usage reported by the kernel, nil if the process is adopted
+	Rusage *syscall.Rusage
+	Err    error
+}
+
+// newExitRecord builds the record of the exited process,
+// the status details are unknown for adopted processes
+func newExitRecord(p *process, state ProcessState, err error) ExitRecord {
+	r := ExitRecord{
+		Pid:       p.Pid(),
+		StartTime: p.sTime,
+		EndTime:   p.eTime,
+		State:     state,
+		ExitCode:  -1,
+		Err:       err,
+	}
+	ps := p.state()
+	if ps == nil {
+		return r
+	}
+	r.ExitCode = ps.ExitCode()
+	r.UserTime = ps.UserTime()
+	r.SysTime = ps.SystemTime()
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		r.Signal = ws.Signal()
+		r.CoreDumped = ws.CoreDump()
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		r.Rusage = ru
+		// ru_maxrss is in kilobytes on Linux
+		r.MaxRSS = ru.Maxrss << 10
+	}
+	return r
+}
+
+// recordExit updates the statistics after the process exited in the given state
+func (d *Daemon) recordExit(state ProcessState, err error) ExitRecord {
+	r := newExitRecord(d.proc, state, err)
+	d.runStat.Lock()
+	defer d.runStat.Unlock()
+	d.runStat.LastStartTime = r.StartTime
+	d.runStat.LastEndTime = r.EndTime
+	d.runStat.LastUpTime = r.EndTime.Sub(r.StartTime)
+	d.runStat.LastUserTime = r.UserTime
+	d.runStat.LastSysTime = r.SysTime
+	d.runStat.LastExitErr = err
+	d.runStat.Pid = 0
+	d.runStat.ExitHistory = append(d.runStat.ExitHistory, r)
+	if n := len(d.runStat.ExitHistory) - d.cfg.ExitHistorySize; n > 0 {
+		// drop the oldest records
+		d.runStat.ExitHistory = d.runStat.ExitHistory[n:]
+	}
+	return r
+}
+
+// exitedForGood returns true if the process exited and isn't restarted by the AutoRestart policy
+func (d *Daemon) exitedForGood() bool {
+	if d.ProcessState() != ProcStatExited {
+		return false
+	}
+	d.runStat.RLock()
+	defer d.runStat.RUnlock()
+	n := len(d.runStat.ExitHistory)
+	if n == 0 {
+		return false
+	}
+	// exiting when starting is a failed start, which is retried until FATAL
+	r := d.runStat.ExitHistory[n-1]
+	return r.State == ProcStatRunning && !d.cfg.shouldRestart(r.ExitCode)
 }
 
 // GetRunningStat return a RunStat Object containing the statistics of the daemon runtime
 func (d *Daemon) GetRunningStat() *RunStat {
 	d.runStat.Lock()
 	defer d.runStat.Unlock()
+	droppedLines, droppedBytes := d.logBuffer.Dropped()
 	return &RunStat{
 		LastStartTime:      d.runStat.LastStartTime,
 		LastEndTime:        d.runStat.LastEndTime,
@@ -41,5 +141,9 @@ func (d *Daemon) GetRunningStat() *RunStat {
 		ExitedCount:        d.runStat.ExitedCount,
 		KilledCount:        d.runStat.KilledCount,
 		Pid:                d.runStat.Pid,
+		Usage:              d.runStat.Usage,
+		ExitHistory:        append([]ExitRecord(nil), d.runStat.ExitHistory...),
+		LogDroppedLines:    droppedLines,
+		LogDroppedBytes:    droppedBytes,
 	}
 }
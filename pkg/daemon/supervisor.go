@@ -0,0 +1,354 @@
+package daemon
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// dependencyCheckInterval is the period to check whether dependencies are satisfied
+const dependencyCheckInterval time.Duration = 100 * time.Millisecond
+
+// Supervisor manages a group of named daemons, it starts and stops them together
+// and terminates all processes when the supervising context is canceled.
+// Daemons are started after their dependencies and stopped before them
+type Supervisor struct {
+	mu      sync.RWMutex
+	ctx     context.Context
+	closed  bool
+	names   []string
+	daemons map[string]*Daemon
+	// cancels keeps the cancel functions of the contexts of supervised daemons
+	cancels map[string]context.CancelFunc
+}
+
+// NewSupervisor creates a new supervisor instance
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		daemons: make(map[string]*Daemon),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// Add registers a daemon to the supervisor, the daemon name must be unique.
+// If the supervisor is already supervising, the daemon is supervised
+// as soon as its dependencies are satisfied.
+// The daemon is closed if it can't be registered
+func (s *Supervisor) Add(d *Daemon) error {
+	s.mu.Lock()
+	name := d.Name()
+	if dd, ok := s.daemons[name]; ok {
+		s.mu.Unlock()
+		if dd != d {
+			d.Close()
+		}
+		return errors.Errorf("daemon [%s] already exists", name)
+	}
+	s.daemons[name] = d
+	s.names = append(s.names, name)
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	if ctx == nil {
+		return nil
+	}
+	if _, err := s.order(); err != nil {
+		s.remove(name)
+		d.Close()
+		return err
+	}
+	return s.supervise(ctx, d)
+}
+
+func (s *Supervisor) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.daemons, name)
+	for i, n := range s.names {
+		if n == name {
+			s.names = append(s.names[:i], s.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get returns the daemon registered with the given name
+func (s *Supervisor) Get(name string) (*Daemon, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.daemons[name]
+	return d, ok
+}
+
+// Names returns the names of all registered daemons in registration order
+func (s *Supervisor) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, len(s.names))
+	copy(names, s.names)
+	return names
+}
+
+// order sorts the daemons so that every daemon comes after its dependencies,
+// the daemons without dependency between them keep registration order.
+// It returns an error if there is an unknown dependency or a dependency cycle
+func (s *Supervisor) order() ([]*Daemon, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	var (
+		sorted []*Daemon
+		path   []string
+		marks  = make(map[string]int)
+		visit  func(name string) error
+	)
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			i := 0
+			for path[i] != name {
+				i++
+			}
+			cycle := append(path[i:], name)
+			return errors.Errorf("dependency cycle detected: %s", strings.Join(cycle, " -> "))
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		d := s.daemons[name]
+		for _, dep := range d.cfg.DependsOn {
+			if _, ok := s.daemons[dep.Name]; !ok {
+				return errors.Errorf("daemon [%s] depends on unknown daemon [%s]", name, dep.Name)
+			}
+			if err := visit(dep.Name); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		sorted = append(sorted, d)
+		return nil
+	}
+	for _, name := range s.names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// Supervise starts to supervise all registered daemons in dependency order,
+// it returns after all daemons are started, or a dependency can't be satisfied.
+// When the context is canceled, all processes are terminated in reverse order
+func (s *Supervisor) Supervise(ctx context.Context) error {
+	ds, err := s.order()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.shutdown()
+	}()
+
+	for _, d := range ds {
+		if err = s.supervise(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervise starts to supervise the daemon after its dependencies are satisfied
+func (s *Supervisor) supervise(ctx context.Context, d *Daemon) error {
+	if err := s.waitDependencies(ctx, d); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.Errorf("supervisor is shutting down, can't supervise daemon [%s]", d.Name())
+	}
+	dctx, cancel := context.WithCancel(context.Background())
+	s.cancels[d.Name()] = cancel
+	s.mu.Unlock()
+
+	if err := d.Supervise(dctx); err != nil {
+		s.mu.Lock()
+		delete(s.cancels, d.Name())
+		s.mu.Unlock()
+		cancel()
+		return err
+	}
+	return nil
+}
+
+// shutdown terminates the supervised daemons one by one in reverse dependency order
+func (s *Supervisor) shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	ds, err := s.order()
+	if err != nil {
+		// it's impossible since the order is checked when adding daemons
+		log.Errorf("get daemons order failed: %+v", err)
+		return
+	}
+	for i := len(ds) - 1; i >= 0; i-- {
+		d := ds[i]
+		s.mu.RLock()
+		cancel, ok := s.cancels[d.Name()]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		cancel()
+		<-d.Done()
+	}
+}
+
+// waitDependencies blocks until all dependencies of the daemon are satisfied
+func (s *Supervisor) waitDependencies(ctx context.Context, d *Daemon) error {
+	for _, dep := range d.cfg.DependsOn {
+		dd, ok := s.Get(dep.Name)
+		if !ok {
+			return errors.Errorf("daemon [%s] depends on unknown daemon [%s]", d.Name(), dep.Name)
+		}
+		if err := waitCondition(ctx, dd, dep.Condition); err != nil {
+			return errors.Wrapf(err, "daemon [%s] waiting for dependency failed", d.Name())
+		}
+	}
+	return nil
+}
+
+func waitCondition(ctx context.Context, d *Daemon, cond DependCondition) error {
+	ticker := time.NewTicker(dependencyCheckInterval)
+	defer ticker.Stop()
+	for {
+		switch cond {
+		case DependHealthy:
+			if d.Healthy() {
+				return nil
+			}
+		default:
+			if d.ProcessState() == ProcStatRunning {
+				return nil
+			}
+		}
+		if s := d.ProcessState(); s == ProcStatFatal || d.exitedForGood() {
+			return errors.Errorf("dependency [%s] is in %v state", d.Name(), s)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for dependency [%s] to be %v", d.Name(), cond)
+		case <-d.Done():
+			return errors.Errorf("dependency [%s] is not supervised any more", d.Name())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start sends an UP signal to every daemon which is not running in dependency order
+func (s *Supervisor) Start() error {
+	ds, err := s.order()
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	ctx := s.ctx
+	s.mu.RUnlock()
+	if ctx == nil {
+		return errors.New("supervisor is not supervising")
+	}
+
+	for _, d := range ds {
+		switch d.ProcessState() {
+		case ProcStatStopped, ProcStatKilled, ProcStatExited, ProcStatFatal:
+			if err = s.waitDependencies(ctx, d); err != nil {
+				return err
+			}
+			if err = d.Signal(SignalUp); err != nil {
+				return errors.Wrapf(err, "start daemon [%s] failed", d.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// Stop sends a DOWN signal to every running or starting daemon in reverse dependency order,
+// and waits for each process to be stopped before stopping its dependencies.
+// A starting daemon is either in its StartSecs window or waiting for the restart backoff
+func (s *Supervisor) Stop() error {
+	ds, err := s.order()
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for i := len(ds) - 1; i >= 0; i-- {
+		d := ds[i]
+		switch d.ProcessState() {
+		case ProcStatRunning, ProcStatStarting:
+		default:
+			continue
+		}
+		if err = stopDaemon(d); err != nil {
+			log.WithField("daemon", d.Name()).Warnf("stop daemon failed: %+v", err)
+			if first == nil {
+				first = errors.Wrapf(err, "stop daemon [%s] failed", d.Name())
+			}
+		}
+	}
+	return first
+}
+
+// stopDaemon sends a DOWN signal to the daemon and waits for it to leave STOPPING state
+func stopDaemon(d *Daemon) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// watch before signaling to not miss the state change
+	events := d.Watch(ctx)
+	if err := d.Signal(SignalDown); err != nil {
+		return err
+	}
+	for d.ProcessState() == ProcStatStopping {
+		e, ok := <-events
+		if !ok {
+			// the daemon stops supervising
+			return nil
+		}
+		if e.Type == sink.EventStateChanged && e.From == ProcStatStopping {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Wait blocks until all supervised daemons exit supervising,
+// it's usually called after the supervising context is canceled
+func (s *Supervisor) Wait() {
+	s.mu.RLock()
+	ds := make([]*Daemon, 0, len(s.cancels))
+	for name := range s.cancels {
+		ds = append(ds, s.daemons[name])
+	}
+	s.mu.RUnlock()
+	for _, d := range ds {
+		<-d.Done()
+	}
+}
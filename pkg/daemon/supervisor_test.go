@@ -0,0 +1,260 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisorRegister(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(NewDaemonConfig(t, "test_supervisor_register"), lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.NoError(t, s.Add(d))
+	// duplicated name
+	assert.Error(t, s.Add(d))
+	// the same name in another status dir
+	cfg := NewDaemonConfig(t, "test_supervisor_register")
+	dup, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.Error(t, s.Add(dup))
+	// the lock is released
+	dup, err = New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.NoError(t, dup.Close())
+	assert.Error(t, dup.Supervise(context.Background()))
+	got, ok := s.Get("test_supervisor_register")
+	assert.True(t, ok)
+	assert.Equal(t, d, got)
+	_, ok = s.Get("not_exists")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"test_supervisor_register"}, s.Names())
+}
+
+func TestSupervisorStopAndStart(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	for _, name := range []string{"test_supervisor_a", "test_supervisor_b"} {
+		d, err := New(NewDaemonConfig(t, name), lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+	}
+	// start to supervise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, s.Supervise(ctx))
+	pids := make(map[string]int)
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		assert.Equal(t, ProcStatRunning, d.ProcessState())
+		pids[name] = d.proc.Pid()
+	}
+	// stop all, it returns after all processes are stopped
+	assert.NoError(t, s.Stop())
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		assert.Equal(t, ProcStatStopped, d.ProcessState())
+		assert.False(t, isRunning(pids[name]))
+	}
+	// start all
+	events := s.Watch(ctx)
+	assert.NoError(t, s.Start())
+	waitForState(t, events, ProcStatRunning)
+	waitForState(t, events, ProcStatRunning)
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		assert.Equal(t, ProcStatRunning, d.ProcessState())
+		assert.Equal(t, uint32(2), d.GetRunningStat().RunCount)
+	}
+}
+
+func TestSupervisorShutdown(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	for _, name := range []string{"test_supervisor_shutdown_a", "test_supervisor_shutdown_b"} {
+		d, err := New(NewDaemonConfig(t, name), lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, s.Supervise(ctx))
+	var pids []int
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		assert.Equal(t, ProcStatRunning, d.ProcessState())
+		pids = append(pids, d.proc.Pid())
+	}
+	// cancel the context, all processes should be terminated
+	cancel()
+	s.Wait()
+	for _, pid := range pids {
+		assert.False(t, isRunning(pid))
+	}
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		assert.Equal(t, ProcStatTerminating, d.ProcessState())
+	}
+}
+
+func TestSupervisorDependencyOrder(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	deps := map[string][]Dependency{
+		"test_supervisor_tidb": {{Name: "test_supervisor_tikv", Condition: DependHealthy}},
+		"test_supervisor_tikv": {{Name: "test_supervisor_pd"}},
+		"test_supervisor_pd":   nil,
+	}
+	// register in reverse order
+	for _, name := range []string{"test_supervisor_tidb", "test_supervisor_tikv", "test_supervisor_pd"} {
+		cfg := NewDaemonConfig(t, name)
+		cfg.StartSecs = 200 * time.Millisecond
+		cfg.DependsOn = deps[name]
+		d, err := New(cfg, lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, s.Supervise(ctx))
+	pd, _ := s.Get("test_supervisor_pd")
+	tikv, _ := s.Get("test_supervisor_tikv")
+	tidb, _ := s.Get("test_supervisor_tidb")
+	for _, d := range []*Daemon{pd, tikv, tidb} {
+		assert.Equal(t, ProcStatRunning, d.ProcessState())
+	}
+	// started one by one
+	assert.True(t, pd.GetRunningStat().StartTime.Before(tikv.GetRunningStat().StartTime))
+	assert.True(t, tikv.GetRunningStat().StartTime.Before(tidb.GetRunningStat().StartTime))
+	// stopped in reverse order
+	cancel()
+	s.Wait()
+	assert.True(t, tidb.GetRunningStat().LastEndTime.Before(tikv.GetRunningStat().LastEndTime))
+	assert.True(t, tikv.GetRunningStat().LastEndTime.Before(pd.GetRunningStat().LastEndTime))
+}
+
+func TestSupervisorDependencyError(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	deps := map[string][]Dependency{
+		"test_supervisor_cycle_a": {{Name: "test_supervisor_cycle_b"}},
+		"test_supervisor_cycle_b": {{Name: "test_supervisor_cycle_a"}},
+	}
+	for _, name := range []string{"test_supervisor_cycle_a", "test_supervisor_cycle_b"} {
+		cfg := NewDaemonConfig(t, name)
+		cfg.DependsOn = deps[name]
+		d, err := New(cfg, lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := s.Supervise(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "dependency cycle detected")
+
+	s = NewSupervisor()
+	cfg := NewDaemonConfig(t, "test_supervisor_unknown")
+	cfg.DependsOn = []Dependency{{Name: "not_exists"}}
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.NoError(t, s.Add(d))
+	err = s.Supervise(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown daemon")
+}
+
+func TestSupervisorDependencyFailed(t *testing.T) {
+	lsf := sink.NewDummyLogSinkFactory()
+	newSupervisor := func(dep *Config, cond DependCondition) (*Supervisor, *Daemon) {
+		s := NewSupervisor()
+		d, err := New(dep, lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+		cfg := NewDaemonConfig(t, dep.Name+"_dependent")
+		cfg.DependsOn = []Dependency{{Name: dep.Name, Condition: cond}}
+		dd, err := New(cfg, lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(dd))
+		return s, dd
+	}
+
+	// the dependency can't be started, its supervising ends
+	cfg := NewDaemonConfig(t, "test_supervisor_dependency_not_exists")
+	cfg.Cmd = "/nonexistent/command"
+	s, dd := newSupervisor(cfg, DependStarted)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.Supervise(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not supervised")
+	assert.Equal(t, ProcStatStopped, dd.ProcessState())
+	cancel()
+	s.Wait()
+	assert.NoError(t, dd.Close())
+
+	// the dependency exited before being healthy and isn't restarted by the policy
+	cfg = NewDaemonConfig(t, "test_supervisor_dependency_exited")
+	cfg.Args = []string{"0.3"}
+	cfg.AutoRestart = AutoRestartNever
+	cfg.LivenessProbes = []Probe{{Exec: &ExecAction{Cmd: "true"}, InitialDelay: time.Hour}}
+	s, dd = newSupervisor(cfg, DependHealthy)
+	ctx, cancel = context.WithCancel(context.Background())
+	err = s.Supervise(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ProcStatExited.String())
+	assert.Equal(t, ProcStatStopped, dd.ProcessState())
+	cancel()
+	s.Wait()
+	assert.NoError(t, dd.Close())
+}
+
+func TestSupervisorWatch(t *testing.T) {
+	s := NewSupervisor()
+	lsf := sink.NewDummyLogSinkFactory()
+	for _, name := range []string{"test_supervisor_watch_a", "test_supervisor_watch_b"} {
+		d, err := New(NewDaemonConfig(t, name), lsf, sink.NewDummyEventSink())
+		assert.NoError(t, err)
+		assert.NoError(t, s.Add(d))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wctx, wcancel := context.WithCancel(context.Background())
+	events := s.Watch(wctx)
+	assert.NoError(t, s.Supervise(ctx))
+	running := make(map[string]bool)
+	for len(running) < 2 {
+		e := <-events
+		if e.Type == sink.EventStateChanged && e.To == ProcStatRunning {
+			running[e.Daemon] = true
+		}
+	}
+	assert.True(t, running["test_supervisor_watch_a"])
+	assert.True(t, running["test_supervisor_watch_b"])
+	// the channel is closed after the context is canceled
+	wcancel()
+	for range events {
+	}
+	cancel()
+	s.Wait()
+}
+
+func TestSupervisorStopStarting(t *testing.T) {
+	s := NewSupervisor()
+	cfg := NewDaemonConfig(t, "test_supervisor_backoff")
+	cfg.Cmd = "sh"
+	cfg.Args = []string{"-c", "exit 1"}
+	cfg.Restart = RestartPolicy{InitialBackoff: time.Hour}
+	d, err := New(cfg, sink.NewDummyLogSinkFactory(), sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	assert.NoError(t, s.Add(d))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := d.Watch(ctx)
+	assert.NoError(t, s.Supervise(ctx))
+	waitForState(t, events, ProcStatExited)
+	waitForState(t, events, ProcStatStarting)
+	// the daemon waiting for the restart backoff is stopped too
+	assert.NoError(t, s.Stop())
+	assert.Equal(t, ProcStatStopped, d.ProcessState())
+}
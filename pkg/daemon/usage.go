@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"golang.org/x/sys/unix"
+)
+
+const defaultSampleInterval time.Duration = 10 * time.Second
+
+// ResourceUsage is the resource usage of the process group sampled from /proc
+type ResourceUsage struct {
+	// SampleTime is the time of the sample, zero if not sampled yet
+	SampleTime time.Time
+	// Processes is the number of live processes in the group
+	Processes int
+	// RSS is the resident memory in bytes
+	RSS uint64
+	// CPUPercent is the CPU usage since the last sample, 100 means one CPU,
+	// it's zero on the first sample
+	CPUPercent float64
+	Threads    int
+	// OpenFiles is the number of open file descriptors
+	OpenFiles int
+	// MaxOpenFiles is the soft RLIMIT_NOFILE of the main process
+	MaxOpenFiles uint64
+	// ReadBytes and WriteBytes are the bytes read from and written to storage
+	// by the live processes
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// startSampler samples the resource usage of the process group periodically
+func (d *Daemon) startSampler(pid int) {
+	d.stopSampler()
+	ctx, cancel := context.WithCancel(context.Background())
+	d.sampleCancel = cancel
+	go d.runSampler(ctx, pid)
+}
+
+// stopSampler stops sampling and clears the usage, it never blocks
+func (d *Daemon) stopSampler() {
+	if d.sampleCancel == nil {
+		return
+	}
+	d.sampleCancel()
+	d.sampleCancel = nil
+	d.runStat.Lock()
+	d.runStat.Usage = ResourceUsage{}
+	d.runStat.Unlock()
+}
+
+func (d *Daemon) runSampler(ctx context.Context, pid int) {
+	ticker := time.NewTicker(d.cfg.SampleInterval)
+	defer ticker.Stop()
+	var (
+		lastTicks uint64
+		lastTime  time.Time
+	)
+	for {
+		usage, ticks, err := sampleGroup(pid)
+		if err != nil {
+			log.WithField("daemon", d.cfg.Name).Warnf("sample resource usage failed: %+v", err)
+		} else {
+			if !lastTime.IsZero() && ticks > lastTicks {
+				elapsed := usage.SampleTime.Sub(lastTime).Seconds()
+				usage.CPUPercent = float64(ticks-lastTicks) / clockTicks / elapsed * 100
+			}
+			lastTicks, lastTime = ticks, usage.SampleTime
+			d.runStat.Lock()
+			// the process may have exited during sampling
+			if ctx.Err() == nil {
+				d.runStat.Usage = *usage
+			}
+			d.runStat.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sampleGroup returns the resource usage and the total CPU ticks of the process group,
+// the group id is the pid of the main process
+func sampleGroup(pgid int) (*ResourceUsage, uint64, error) {
+	pids, err := listProcGroup(pgid)
+	if err != nil {
+		return nil, 0, err
+	}
+	usage := &ResourceUsage{SampleTime: time.Now()}
+	var ticks uint64
+	for _, pid := range pids {
+		u, err := readProcUsage(pid)
+		if err != nil {
+			// the process has exited
+			continue
+		}
+		usage.Processes++
+		usage.RSS += u.rss
+		usage.Threads += u.threads
+		usage.OpenFiles += u.fds
+		usage.ReadBytes += u.readBytes
+		usage.WriteBytes += u.writeBytes
+		ticks += u.cpuTicks
+	}
+	var lim unix.Rlimit
+	if err = unix.Prlimit(pgid, unix.RLIMIT_NOFILE, nil, &lim); err == nil {
+		usage.MaxOpenFiles = lim.Cur
+	}
+	return usage, ticks, nil
+}
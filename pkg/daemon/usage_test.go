@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleUsage(t *testing.T) {
+	cfg := NewDaemonConfig(t, "test_sample_usage")
+	cfg.Cmd = "sh"
+	// a busy process and an idle one in the same group
+	cfg.Args = []string{"-c", "sleep 3600 & while :; do :; done"}
+	cfg.SampleInterval = 200 * time.Millisecond
+	lsf := sink.NewDummyLogSinkFactory()
+	d, err := New(cfg, lsf, sink.NewDummyEventSink())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Supervise(ctx)
+
+	var usage ResourceUsage
+	for i := 0; i < 50; i++ {
+		usage = d.GetRunningStat().Usage
+		if usage.CPUPercent > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 2, usage.Processes)
+	assert.True(t, usage.RSS > 0)
+	assert.True(t, usage.CPUPercent > 10)
+	assert.True(t, usage.Threads >= 2)
+	assert.True(t, usage.OpenFiles > 0)
+	assert.True(t, usage.MaxOpenFiles > 0)
+
+	// the usage is cleared after the process exits
+	cancel()
+	<-d.Done()
+	assert.True(t, d.GetRunningStat().Usage.SampleTime.IsZero())
+}
@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+)
+
+// WatchBufferSize is the number of events buffered for each watcher.
+// When a watcher falls behind and its buffer is full, the oldest buffered
+// event is dropped to make room for the new one, so the latest state is
+// never lost and the daemon is never blocked by slow watchers
+const WatchBufferSize = 64
+
+// watchers keeps the subscribers of daemon events
+type watchers struct {
+	mu   sync.Mutex
+	subs map[chan sink.Event]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		subs: make(map[chan sink.Event]struct{}),
+	}
+}
+
+// subscribe adds a subscriber which is removed and closed when ctx is done or stopc is closed
+func (w *watchers) subscribe(ctx context.Context, stopc <-chan struct{}) <-chan sink.Event {
+	ch := make(chan sink.Event, WatchBufferSize)
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopc:
+		}
+		w.mu.Lock()
+		delete(w.subs, ch)
+		close(ch)
+		w.mu.Unlock()
+	}()
+	return ch
+}
+
+// publish sends the event to all subscribers without blocking
+func (w *watchers) publish(e sink.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		sendDropOldest(ch, e)
+	}
+}
+
+// sendDropOldest sends the event to the channel, drops the oldest event if the channel is full
+func sendDropOldest(ch chan sink.Event, e sink.Event) {
+	for {
+		select {
+		case ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// Watch returns a channel receiving the lifecycle events of the daemon,
+// the channel is closed when ctx is done or the daemon stops supervising.
+// See WatchBufferSize for the overflow policy
+func (d *Daemon) Watch(ctx context.Context) <-chan sink.Event {
+	return d.watchers.subscribe(ctx, d.donech)
+}
+
+// Watch returns a channel receiving the lifecycle events of all registered daemons,
+// the channel is closed when ctx is done or all daemons stop supervising.
+// Daemons added after calling Watch are not watched.
+// See WatchBufferSize for the overflow policy
+func (s *Supervisor) Watch(ctx context.Context) <-chan sink.Event {
+	var wg sync.WaitGroup
+	ch := make(chan sink.Event, WatchBufferSize)
+	s.mu.RLock()
+	for _, name := range s.names {
+		wg.Add(1)
+		go func(in <-chan sink.Event) {
+			defer wg.Done()
+			for e := range in {
+				sendDropOldest(ch, e)
+			}
+		}(s.daemons[name].Watch(ctx))
+	}
+	s.mu.RUnlock()
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/tipervisor/pkg/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchDropOldest(t *testing.T) {
+	w := newWatchers()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := w.subscribe(ctx, nil)
+	for i := 0; i < WatchBufferSize+10; i++ {
+		w.publish(sink.Event{RunCount: uint32(i)})
+	}
+	assert.Len(t, events, WatchBufferSize)
+	// the oldest events are dropped
+	e := <-events
+	assert.Equal(t, uint32(10), e.RunCount)
+	// unsubscribe
+	cancel()
+	n := 0
+	for range events {
+		n++
+	}
+	assert.Equal(t, WatchBufferSize-1, n)
+	w.mu.Lock()
+	assert.Empty(t, w.subs)
+	w.mu.Unlock()
+}
@@ -0,0 +1,45 @@
+package sink
+
+// BufferConfig configures the buffer between the process output and a log sink
+type BufferConfig struct {
+	// Policy decides what to do when the buffer is full, default is DropOldest
+	Policy OverflowPolicy
+	// MaxBytes is the max bytes of the buffered lines, zero means no limit
+	MaxBytes int
+	// MaxLines is the max number of the buffered lines, zero means no limit
+	MaxLines int
+}
+
+// BufferedLogSinkFactory decouples the process output from a slow log sink by a bounded buffer,
+// the lines dropped by the buffer and the queues of the nested sinks are counted together,
+// including the lines left in them when the sinks are stopped
+type BufferedLogSinkFactory struct {
+	next    LogSinkFactory
+	cfg     BufferConfig
+	dropped DropCounter
+}
+
+// NewBufferedLogSinkFactory creates a log sink factory which buffers the output
+// for the sinks created by next
+func NewBufferedLogSinkFactory(next LogSinkFactory, cfg BufferConfig) *BufferedLogSinkFactory {
+	return &BufferedLogSinkFactory{next: next, cfg: cfg}
+}
+
+// NewLogSink creates a log sink which reads the output into the buffer,
+// and delivers the buffered lines to a new sink of next
+func (f *BufferedLogSinkFactory) NewLogSink() LogSink {
+	s := &MultiLogSink{
+		outputs: []*teeOutput{{
+			sink:  f.next.NewLogSink(),
+			queue: newLineQueue(f.cfg.MaxLines, f.cfg.MaxBytes, f.cfg.Policy, &f.dropped),
+		}},
+	}
+	// the nested sinks count their drops to the buffer too
+	s.countDrops(&f.dropped)
+	return s
+}
+
+// Dropped returns the total number of lines and bytes dropped by the sinks
+func (f *BufferedLogSinkFactory) Dropped() (lines uint64, bytes uint64) {
+	return f.dropped.Dropped()
+}
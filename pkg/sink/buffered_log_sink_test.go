@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedLogSink records the lines after the gate is opened
+type gatedLogSink struct {
+	DummyLogSink
+	mu    sync.Mutex
+	gatec chan struct{}
+	lines []string
+}
+
+func (s *gatedLogSink) WriteLine(l *Line) {
+	<-s.gatec
+	s.mu.Lock()
+	s.lines = append(s.lines, string(l.Data))
+	s.mu.Unlock()
+}
+
+type gatedLogSinkFactory struct {
+	gatec chan struct{}
+	sinks []*gatedLogSink
+}
+
+func (f *gatedLogSinkFactory) NewLogSink() LogSink {
+	s := &gatedLogSink{gatec: f.gatec}
+	f.sinks = append(f.sinks, s)
+	return s
+}
+
+func popAll(q *lineQueue) []string {
+	q.close()
+	var lines []string
+	for {
+		l, ok := q.pop()
+		if !ok {
+			return lines
+		}
+		lines = append(lines, string(l.Data))
+	}
+}
+
+func TestLineQueue(t *testing.T) {
+	cases := []struct {
+		policy   OverflowPolicy
+		maxLines int
+		maxBytes int
+		expected []string
+		dropped  uint64
+	}{
+		{DropOldest, 2, 0, []string{"bb", "ccc"}, 1},
+		{DropNewest, 2, 0, []string{"a", "bb"}, 3},
+		{DropOldest, 0, 5, []string{"bb", "ccc"}, 1},
+		{DropNewest, 0, 4, []string{"a", "bb"}, 3},
+		{DropOldest, 0, 0, []string{"a", "bb", "ccc"}, 0},
+	}
+	for _, c := range cases {
+		dropped := &DropCounter{}
+		q := newLineQueue(c.maxLines, c.maxBytes, c.policy, dropped)
+		for _, s := range []string{"a", "bb", "ccc"} {
+			q.push(Line{Data: []byte(s)})
+		}
+		assert.Equal(t, c.expected, popAll(q), "%v", c.policy)
+		_, bytes := dropped.Dropped()
+		assert.Equal(t, c.dropped, bytes, "%v", c.policy)
+	}
+
+	// the pusher waits for room
+	dropped := &DropCounter{}
+	q := newLineQueue(1, 0, Block, dropped)
+	q.push(Line{Data: []byte("a")})
+	donec := make(chan struct{})
+	go func() {
+		q.push(Line{Data: []byte("b")})
+		close(donec)
+	}()
+	select {
+	case <-donec:
+		t.Fatal("push should be blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "a", string(l.Data))
+	<-donec
+	// the pusher never waits after aborted
+	q.abort()
+	q.push(Line{Data: []byte("c")})
+	assert.Equal(t, []string{"b"}, popAll(q))
+	lines, _ := dropped.Dropped()
+	assert.Equal(t, uint64(1), lines)
+}
+
+func TestBufferedLogSinkBlock(t *testing.T) {
+	gated := &gatedLogSinkFactory{gatec: make(chan struct{})}
+	f := NewBufferedLogSinkFactory(gated, BufferConfig{Policy: Block, MaxLines: 1})
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	n := 100
+	for i := 0; i < n; i++ {
+		pout.WriteString(strconv.Itoa(i) + "\n")
+	}
+	pout.Close()
+	perr.Close()
+	time.Sleep(100 * time.Millisecond)
+	close(gated.gatec)
+	s.Stop()
+	// nothing is lost if the sink catches up in time
+	assert.Len(t, gated.sinks[0].lines, n)
+	assert.Equal(t, strconv.Itoa(n-1), gated.sinks[0].lines[n-1])
+	lines, bytes := f.Dropped()
+	assert.Zero(t, lines)
+	assert.Zero(t, bytes)
+}
+
+func TestBufferedLogSinkStuck(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Block} {
+		gated := &gatedLogSinkFactory{gatec: make(chan struct{})}
+		f := NewBufferedLogSinkFactory(gated, BufferConfig{Policy: policy, MaxBytes: 10})
+		s := f.NewLogSink()
+		pout, perr := startPipes(t, s)
+		for i := 0; i < 100; i++ {
+			pout.WriteString("12345\n")
+		}
+		pout.Close()
+		perr.Close()
+		// a stuck sink never blocks stopping
+		start := time.Now()
+		s.Stop()
+		assert.True(t, time.Since(start) < 3*logDrainTimeout, "%v", policy)
+		// all lines but the one being written are dropped, including the ones left in the buffer
+		lines, bytes := f.Dropped()
+		assert.Equal(t, uint64(99), lines, "%v", policy)
+		assert.Equal(t, 5*lines, bytes, "%v", policy)
+		close(gated.gatec)
+	}
+}
+
+func TestBufferedLogSinkNested(t *testing.T) {
+	gated := &gatedLogSinkFactory{gatec: make(chan struct{})}
+	f := NewBufferedLogSinkFactory(NewMultiLogSinkFactory(gated), BufferConfig{Policy: Block})
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	n := 2 * teeQueueSize
+	for i := 0; i < n; i++ {
+		pout.WriteString("12345\n")
+	}
+	pout.Close()
+	perr.Close()
+	s.Stop()
+	// the lines dropped by the queue of the nested sink are counted by the buffer
+	lines, bytes := f.Dropped()
+	assert.Equal(t, uint64(n-1), lines)
+	assert.Equal(t, 5*lines, bytes)
+	close(gated.gatec)
+}
@@ -0,0 +1,15 @@
+package sink
+
+// DummyEventSink implements dummy event sink for testing use
+type DummyEventSink struct {
+}
+
+// Emit drops the event
+func (s *DummyEventSink) Emit(e *Event) {
+	// do nothing
+}
+
+// NewDummyEventSink returns a dummy event sink
+func NewDummyEventSink() EventSink {
+	return &DummyEventSink{}
+}
@@ -18,6 +18,11 @@ func (s *DummyLogSink) Stop() {
 	// do nothing
 }
 
+// WriteLine drops the line
+func (s *DummyLogSink) WriteLine(l *Line) {
+	// do nothing
+}
+
 // DummyLogSinkFactory implements dummy log sink factory
 type DummyLogSinkFactory struct {
 }
@@ -1,5 +1,58 @@
 package sink
 
-// EventSink do ...
+import (
+	"fmt"
+	"time"
+)
+
+// EventType defines the kinds of daemon lifecycle events
+type EventType int
+
+// Enum values of the EventType type
+const (
+	// EventStateChanged is emitted when the daemon changes its process state
+	EventStateChanged EventType = iota
+	// EventProcessStarted is emitted when a new process is started
+	EventProcessStarted
+	// EventProcessExited is emitted when the process exits
+	EventProcessExited
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStateChanged:
+		return "STATE_CHANGED"
+	case EventProcessStarted:
+		return "PROCESS_STARTED"
+	case EventProcessExited:
+		return "PROCESS_EXITED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Event describes a lifecycle event of a daemon
+type Event struct {
+	Type   EventType
+	Daemon string
+	Pid    int
+	// From and To are the daemon.ProcessState values before and after a state change,
+	// for process started or exited events both are the state when it happens
+	From fmt.Stringer
+	To   fmt.Stringer
+	Time time.Time
+	// ExitErr is the error returned by the exited process, nil if it exits with code zero
+	ExitErr  error
+	RunCount uint32
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%v daemon=%s pid=%d from=%v to=%v run=%d err=%v",
+		e.Type, e.Daemon, e.Pid, e.From, e.To, e.RunCount, e.ExitErr)
+}
+
+// EventSink receives the lifecycle events of daemons, Emit is called
+// synchronously by the supervising goroutine, so it must not block
 type EventSink interface {
+	Emit(e *Event)
 }
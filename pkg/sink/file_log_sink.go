@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// FileLogConfig configures the files which the output of a daemon is written to,
+// stdout and stderr go to <Dir>/<Name>.stdout.log and <Dir>/<Name>.stderr.log.
+// The lines tailed from the log files of the process go to the file of stdout,
+// prefixed by "[<path>] " to tell them from the output
+type FileLogConfig struct {
+	Dir  string
+	Name string
+	// MaxSize is the size in bytes to rotate the file at, zero means no limit
+	MaxSize int64
+	// RotateInterval is the time to rotate the file after it's opened, zero means never.
+	// The file is rotated on the first write after the interval
+	RotateInterval time.Duration
+	// MaxBackups is the number of rotated files kept, zero means keeping all
+	MaxBackups int
+	// Compress gzips the rotated files
+	Compress bool
+	// User owns the log files, it should be the same as the User of the daemon
+	User string
+}
+
+// FileLogSinkFactory writes the output of all processes of a daemon to the same rotated files
+type FileLogSinkFactory struct {
+	cfg    FileLogConfig
+	stdout *rotateFile
+	stderr *rotateFile
+}
+
+// NewFileLogSinkFactory opens the log files, the directory is created if not exists
+func NewFileLogSinkFactory(cfg FileLogConfig) (*FileLogSinkFactory, error) {
+	if cfg.Dir == "" || cfg.Name == "" {
+		return nil, errors.New("log directory and name are required")
+	}
+	uid, gid := -1, -1
+	if cfg.User != "" {
+		u, err := user.Lookup(cfg.User)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup log file owner [%s] failed", cfg.User)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, errors.Wrap(err, "invalid uid")
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, errors.Wrap(err, "invalid gid")
+		}
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create log directory [%s] failed", cfg.Dir)
+	}
+
+	f := &FileLogSinkFactory{cfg: cfg}
+	var err error
+	f.stdout, err = openRotateFile(filepath.Join(cfg.Dir, cfg.Name+".stdout.log"), &f.cfg, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	f.stderr, err = openRotateFile(filepath.Join(cfg.Dir, cfg.Name+".stderr.log"), &f.cfg, uid, gid)
+	if err != nil {
+		f.stdout.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewLogSink creates a log sink writing to the files
+func (f *FileLogSinkFactory) NewLogSink() LogSink {
+	return &FileLogSink{factory: f}
+}
+
+// write writes the line including the line break to the file of the stream
+func (f *FileLogSinkFactory) write(s Stream, line []byte) {
+	file := f.stdout
+	if s == Stderr {
+		file = f.stderr
+	}
+	if _, err := file.Write(line); err != nil {
+		log.WithField("daemon", f.cfg.Name).Warnf("%+v", err)
+	}
+}
+
+// Close closes the log files, it should be called after the daemon stops supervising
+func (f *FileLogSinkFactory) Close() error {
+	err := f.stdout.Close()
+	if serr := f.stderr.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// FileLogSink writes the output of a process to the files of its factory
+type FileLogSink struct {
+	factory *FileLogSinkFactory
+	reader  pipeReader
+}
+
+// Start gets log sink to work
+func (s *FileLogSink) Start(pout, perr *os.File) {
+	s.reader.start(pout, perr, s.factory.write)
+}
+
+// WriteLine writes a line to the file of its stream, the line tailed from a file is prefixed by the path
+func (s *FileLogSink) WriteLine(l *Line) {
+	line := make([]byte, 0, len(l.Source)+len(l.Data)+4)
+	if l.Source != "" {
+		line = append(append(append(line, '['), l.Source...), "] "...)
+	}
+	line = append(append(line, l.Data...), '\n')
+	s.factory.write(l.Stream, line)
+}
+
+// Stop terminates log sink after the output is drained
+func (s *FileLogSink) Stop() {
+	s.reader.stop()
+}
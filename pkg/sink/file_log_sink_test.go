@@ -0,0 +1,183 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startPipes starts the sink with new pipes and returns the write ends
+func startPipes(t *testing.T, s LogSink) (*os.File, *os.File) {
+	prOut, pwOut, err := os.Pipe()
+	assert.NoError(t, err)
+	prErr, pwErr, err := os.Pipe()
+	assert.NoError(t, err)
+	s.Start(prOut, prErr)
+	return pwOut, pwErr
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestFileLogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_file_log_sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFileLogSinkFactory(FileLogConfig{Dir: dir, Name: "tikv"})
+	assert.NoError(t, err)
+	// the output of processes is appended to the same files
+	for i := 0; i < 2; i++ {
+		s := f.NewLogSink()
+		pout, perr := startPipes(t, s)
+		pout.WriteString("out " + strconv.Itoa(i) + "\n")
+		perr.WriteString("err " + strconv.Itoa(i) + "\n")
+		pout.Close()
+		perr.Close()
+		s.Stop()
+	}
+	// the lines tailed from log files are tagged with the path
+	s := f.NewLogSink()
+	s.Start(nil, nil)
+	s.(LineWriter).WriteLine(&Line{Stream: Stdout, Source: "tikv.log", Data: []byte("file 0")})
+	s.Stop()
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "out 0\nout 1\n[tikv.log] file 0\n", readFile(t, filepath.Join(dir, "tikv.stdout.log")))
+	assert.Equal(t, "err 0\nerr 1\n", readFile(t, filepath.Join(dir, "tikv.stderr.log")))
+}
+
+func TestFileLogSinkDrainTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_file_log_sink_drain")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFileLogSinkFactory(FileLogConfig{Dir: dir, Name: "tikv"})
+	assert.NoError(t, err)
+	defer f.Close()
+	s := f.NewLogSink()
+	// the pipes are kept open, e.g. by an orphaned child
+	pout, perr := startPipes(t, s)
+	defer pout.Close()
+	defer perr.Close()
+	pout.WriteString("line\n")
+	start := time.Now()
+	s.Stop()
+	assert.True(t, time.Since(start) < 2*logDrainTimeout)
+	assert.Equal(t, "line\n", readFile(t, filepath.Join(dir, "tikv.stdout.log")))
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_rotate_by_size")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tikv.log")
+	cfg := &FileLogConfig{MaxSize: 10, MaxBackups: 2}
+	f, err := openRotateFile(path, cfg, -1, -1)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = f.Write([]byte("line " + strconv.Itoa(i) + "\n"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+	// every line goes to a new file
+	assert.Equal(t, "line 4\n", readFile(t, path))
+	backups, err := f.backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	assert.Equal(t, "line 2\n", readFile(t, backups[0]))
+	assert.Equal(t, "line 3\n", readFile(t, backups[1]))
+}
+
+func TestRotateFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_rotate_failed")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() {
+		renameFile = os.Rename
+	}()
+	renameFile = func(string, string) error {
+		return syscall.EACCES
+	}
+
+	path := filepath.Join(dir, "tikv.log")
+	f, err := openRotateFile(path, &FileLogConfig{MaxSize: 10}, -1, -1)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = f.Write([]byte("line " + strconv.Itoa(i) + "\n"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+	// the lines are appended to the file which can't be rotated
+	assert.Equal(t, "line 0\nline 1\nline 2\n", readFile(t, path))
+	backups, err := f.backups()
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+	_, err = f.Write([]byte("line 3\n"))
+	assert.Error(t, err)
+}
+
+func TestRotateByTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_rotate_by_time")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tikv.log")
+	cfg := &FileLogConfig{RotateInterval: 100 * time.Millisecond, Compress: true}
+	f, err := openRotateFile(path, cfg, -1, -1)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("line 0\n"))
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("line 1\n"))
+	assert.NoError(t, err)
+	time.Sleep(cfg.RotateInterval)
+	_, err = f.Write([]byte("line 2\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	assert.Equal(t, "line 2\n", readFile(t, path))
+	backups, err := f.backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	assert.True(t, strings.HasSuffix(backups[0], ".gz"))
+	gz, err := os.Open(backups[0])
+	assert.NoError(t, err)
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, "line 0\nline 1\n", string(data))
+}
+
+func TestFileLogOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root is required to change file owner")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("user nobody doesn't exist")
+	}
+	dir, err := ioutil.TempDir("", "test_file_log_owner")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFileLogSinkFactory(FileLogConfig{Dir: dir, Name: "tikv", User: "nobody"})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	fi, err := os.Stat(filepath.Join(dir, "tikv.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, u.Uid, strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Uid)))
+}
@@ -0,0 +1,214 @@
+package sink
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+)
+
+// defaultTailInterval is the period to check the tailed files for new lines
+const defaultTailInterval = 250 * time.Millisecond
+
+// FileTailer follows the log files written by a process, e.g. the --log-file of TiDB,
+// and feeds the new lines to a log sink tagged with the file path.
+// A file is followed through rotation, the rest of the old file is read
+// before switching to the new one, and it's read from the start again if truncated
+type FileTailer struct {
+	files    []*tailFile
+	w        LineWriter
+	interval time.Duration
+	stopc    chan struct{}
+	donec    chan struct{}
+	stopOnce sync.Once
+}
+
+// tailFile keeps the reading state of a tailed path
+type tailFile struct {
+	path   string
+	file   *os.File
+	ino    uint64
+	offset int64
+	// partial is the last line without the line break yet
+	partial []byte
+}
+
+// NewFileTailer creates a tailer feeding the lines of the files to the writer,
+// the files are checked every interval, zero means 250ms
+func NewFileTailer(paths []string, w LineWriter, interval time.Duration) *FileTailer {
+	if interval <= 0 {
+		interval = defaultTailInterval
+	}
+	t := &FileTailer{
+		w:        w,
+		interval: interval,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+	for _, path := range paths {
+		t.files = append(t.files, &tailFile{path: path})
+	}
+	return t
+}
+
+// Start skips the existing content of the files and follows them in background,
+// the files created later and the rotated ones are read from the start
+func (t *FileTailer) Start() {
+	for _, f := range t.files {
+		if err := f.open(); err != nil {
+			// the file is created later by the process, and read from the start
+			continue
+		}
+		if offset, err := f.file.Seek(0, io.SeekEnd); err == nil {
+			f.offset = offset
+		}
+	}
+	go t.run()
+}
+
+// Stop reads the lines written so far and stops following the files
+func (t *FileTailer) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopc)
+	})
+	<-t.donec
+}
+
+func (t *FileTailer) run() {
+	defer close(t.donec)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopc:
+			for _, f := range t.files {
+				t.poll(f)
+				t.flush(f)
+				f.close()
+			}
+			return
+		case <-ticker.C:
+			for _, f := range t.files {
+				t.poll(f)
+			}
+		}
+	}
+}
+
+// poll reads the new lines of the file, and switches to the new file if it's rotated
+func (t *FileTailer) poll(f *tailFile) {
+	if f.file == nil {
+		if f.open() != nil {
+			return
+		}
+	}
+	if fi, err := f.file.Stat(); err == nil && fi.Size() < f.offset {
+		log.Infof("log file [%s] is truncated, read it from the start", f.path)
+		t.flush(f)
+		f.seek(0)
+	}
+	t.read(f)
+
+	fi, err := os.Stat(f.path)
+	if err != nil || inode(fi) == f.ino {
+		// keep reading the old file until the new one is created
+		return
+	}
+	t.flush(f)
+	f.close()
+	if f.open() == nil {
+		t.read(f)
+	}
+}
+
+// read feeds the complete lines from the offset to the end of the file
+func (t *FileTailer) read(f *tailFile) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := f.file.Read(buf)
+		f.offset += int64(n)
+		data := buf[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				f.partial = append(f.partial, data...)
+				if len(f.partial) >= maxLineSize {
+					t.flush(f)
+				}
+				break
+			}
+			line := data[:i]
+			if len(f.partial) > 0 {
+				line = append(f.partial, line...)
+				f.partial = nil
+			}
+			t.emit(f, line)
+			data = data[i+1:]
+		}
+		if err != nil || n == 0 {
+			if err != nil && err != io.EOF {
+				log.Warnf("read log file [%s] failed: %v", f.path, err)
+			}
+			return
+		}
+	}
+}
+
+// flush feeds the partial line, it's called when no more data will be appended to it
+func (t *FileTailer) flush(f *tailFile) {
+	if len(f.partial) > 0 {
+		t.emit(f, f.partial)
+		f.partial = nil
+	}
+}
+
+func (t *FileTailer) emit(f *tailFile, data []byte) {
+	t.w.WriteLine(&Line{
+		Stream: Stdout,
+		Time:   time.Now(),
+		Source: f.path,
+		Data:   append([]byte(nil), data...),
+	})
+}
+
+func (f *tailFile) open() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.ino = inode(fi)
+	f.offset = 0
+	return nil
+}
+
+func (f *tailFile) seek(offset int64) {
+	if _, err := f.file.Seek(offset, io.SeekStart); err == nil {
+		f.offset = offset
+	}
+}
+
+func (f *tailFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.partial = nil
+}
+
+// inode returns the inode number of the file
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package sink
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(data)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+// tailedLines returns the data of the lines tailed from the path after waiting for n lines
+func tailedLines(t *testing.T, ring *RingLogSinkFactory, path string, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var lines []string
+		for _, l := range ring.Tail(-1) {
+			if l.Source == path {
+				lines = append(lines, string(l.Data))
+			}
+		}
+		if len(lines) >= n || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_file_tailer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tidb.log")
+	later := filepath.Join(dir, "slow.log")
+	appendFile(t, path, "old\n")
+
+	ring := NewRingLogSinkFactory(RingLogConfig{})
+	tailer := NewFileTailer([]string{path, later}, ring.NewLogSink().(LineWriter), 10*time.Millisecond)
+	tailer.Start()
+	// the existing content is skipped, and a line is fed after it's complete
+	appendFile(t, path, "1\n2")
+	assert.Equal(t, []string{"1"}, tailedLines(t, ring, path, 1))
+	appendFile(t, path, "\n")
+	assert.Equal(t, []string{"1", "2"}, tailedLines(t, ring, path, 2))
+
+	// the rest of the rotated file is read before the new one
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path+".1", "3\n")
+	appendFile(t, path, "4\n")
+	assert.Equal(t, []string{"1", "2", "3", "4"}, tailedLines(t, ring, path, 4))
+
+	// the truncated file is read from the start
+	assert.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "5\n6")
+
+	// the file created later is read from the start
+	appendFile(t, later, "slow\n")
+	assert.Equal(t, []string{"slow"}, tailedLines(t, ring, later, 1))
+
+	// the partial line is fed on stop
+	tailer.Stop()
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, tailedLines(t, ring, path, 6))
+}
@@ -0,0 +1,172 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// JournalConfig configures the forwarding of a daemon's output to journald
+type JournalConfig struct {
+	// Name is the daemon name
+	Name string
+	// Socket is the journald socket, default is /run/systemd/journal/socket
+	Socket string
+	// Identifier is the SYSLOG_IDENTIFIER, default is Name
+	Identifier string
+	// Fields are the custom fields added to each entry together with TIPERVISOR_DAEMON,
+	// the names consist of uppercase letters, digits and underscores
+	Fields map[string]string
+}
+
+// JournalSinkFactory forwards each line of the output to journald by its native protocol
+type JournalSinkFactory struct {
+	cfg JournalConfig
+	// fields is the serialized common fields of every entry
+	fields []byte
+	mu     sync.Mutex
+	conn   *net.UnixConn
+}
+
+// NewJournalSinkFactory connects to the journald socket
+func NewJournalSinkFactory(cfg JournalConfig) (*JournalSinkFactory, error) {
+	if cfg.Socket == "" {
+		cfg.Socket = defaultJournalSocket
+	}
+	if cfg.Identifier == "" {
+		cfg.Identifier = cfg.Name
+	}
+	fields, err := checkFields(cfg.Name, cfg.Fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["SYSLOG_IDENTIFIER"] = cfg.Identifier
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, k := range names {
+		appendJournalField(&b, k, []byte(fields[k]))
+	}
+
+	f := &JournalSinkFactory{
+		cfg:    cfg,
+		fields: b.Bytes(),
+	}
+	if err = f.dial(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *JournalSinkFactory) dial() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: f.cfg.Socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrapf(err, "connect to journald [%s] failed", f.cfg.Socket)
+	}
+	f.conn = conn
+	return nil
+}
+
+// appendJournalField serializes a field, the value containing line breaks
+// is written in binary form with its length
+func appendJournalField(b *bytes.Buffer, name string, value []byte) {
+	b.WriteString(name)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.Write(value)
+	} else {
+		b.WriteByte('\n')
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		b.Write(size[:])
+		b.Write(value)
+	}
+	b.WriteByte('\n')
+}
+
+// entry returns the serialized journal entry of the line
+func (f *JournalSinkFactory) entry(l *Line) []byte {
+	var b bytes.Buffer
+	b.Write(f.fields)
+	if l.Source != "" {
+		appendJournalField(&b, FileField, []byte(l.Source))
+	}
+	appendJournalField(&b, "PRIORITY", []byte(strconv.Itoa(l.Stream.severity())))
+	appendJournalField(&b, "MESSAGE", bytes.TrimSuffix(l.Data, []byte("\n")))
+	return b.Bytes()
+}
+
+// write sends the line read from the pipe
+func (f *JournalSinkFactory) write(s Stream, data []byte) {
+	f.writeLine(&Line{Stream: s, Data: data})
+}
+
+// writeLine sends the line, it reconnects once if the socket is broken, e.g. journald is restarted
+func (f *JournalSinkFactory) writeLine(l *Line) {
+	entry := f.entry(l)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return
+	}
+	_, err := f.conn.Write(entry)
+	if err != nil {
+		f.conn.Close()
+		if err = f.dial(); err == nil {
+			_, err = f.conn.Write(entry)
+		}
+	}
+	if err != nil {
+		log.WithField("daemon", f.cfg.Name).Warnf("write journal failed: %v", err)
+	}
+}
+
+// NewLogSink creates a log sink forwarding to journald
+func (f *JournalSinkFactory) NewLogSink() LogSink {
+	return &JournalSink{factory: f}
+}
+
+// Close closes the journald connection
+func (f *JournalSinkFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return errors.Wrap(err, "close journald connection failed")
+}
+
+// JournalSink forwards the output of a process to journald
+type JournalSink struct {
+	factory *JournalSinkFactory
+	reader  pipeReader
+}
+
+// Start gets log sink to work
+func (s *JournalSink) Start(pout, perr *os.File) {
+	s.reader.start(pout, perr, s.factory.write)
+}
+
+// WriteLine forwards the line
+func (s *JournalSink) WriteLine(l *Line) {
+	s.factory.writeLine(l)
+}
+
+// Stop terminates log sink after the output is drained
+func (s *JournalSink) Stop() {
+	s.reader.stop()
+}
@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parseJournalEntry parses the entry of journald native protocol
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		assert.True(t, i > 0)
+		name := string(data[:i])
+		if data[i] == '=' {
+			j := bytes.IndexByte(data, '\n')
+			fields[name] = string(data[i+1 : j])
+			data = data[j+1:]
+			continue
+		}
+		size := int(binary.LittleEndian.Uint64(data[i+1 : i+9]))
+		fields[name] = string(data[i+9 : i+9+size])
+		data = data[i+10+size:]
+	}
+	return fields
+}
+
+func TestJournalSink(t *testing.T) {
+	conn, path, cleanup := listenUnixgram(t)
+	defer cleanup()
+
+	f, err := NewJournalSinkFactory(JournalConfig{
+		Name:       "tikv",
+		Socket:     path,
+		Identifier: "tikv-server",
+		Fields:     map[string]string{"CLUSTER": "test"},
+	})
+	assert.NoError(t, err)
+	defer f.Close()
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString("hello\n")
+	assert.Equal(t, map[string]string{
+		"MESSAGE":           "hello",
+		"PRIORITY":          "6",
+		"SYSLOG_IDENTIFIER": "tikv-server",
+		"TIPERVISOR_DAEMON": "tikv",
+		"CLUSTER":           "test",
+	}, parseJournalEntry(t, []byte(readDatagram(t, conn))))
+	perr.WriteString("oops\r\n")
+	fields := parseJournalEntry(t, []byte(readDatagram(t, conn)))
+	assert.Equal(t, "4", fields["PRIORITY"])
+	assert.Equal(t, "oops\r", fields["MESSAGE"])
+	pout.Close()
+	perr.Close()
+	s.Stop()
+
+	// the value with line breaks is serialized in binary form
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", []byte("a\nb"))
+	assert.Equal(t, map[string]string{"MESSAGE": "a\nb"}, parseJournalEntry(t, b.Bytes()))
+}
@@ -0,0 +1,167 @@
+package sink
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what to do with a new line when a log buffer is full
+type OverflowPolicy int
+
+// Enum values of the OverflowPolicy type
+const (
+	// DropOldest drops the oldest buffered lines to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new line
+	DropNewest
+	// Block waits for room, the process blocks on writing its output
+	// once the pipe is full too
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// DropCounter counts the lines and bytes dropped by log buffers
+type DropCounter struct {
+	lines uint64
+	bytes uint64
+}
+
+func (c *DropCounter) add(l *Line) {
+	c.addN(1, uint64(len(l.Data)))
+}
+
+func (c *DropCounter) addN(lines, bytes uint64) {
+	atomic.AddUint64(&c.lines, lines)
+	atomic.AddUint64(&c.bytes, bytes)
+}
+
+// Dropped returns the number of dropped lines and bytes
+func (c *DropCounter) Dropped() (lines uint64, bytes uint64) {
+	return atomic.LoadUint64(&c.lines), atomic.LoadUint64(&c.bytes)
+}
+
+// lineQueue is a FIFO of lines bounded by count and bytes
+type lineQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	lines    []Line
+	bytes    int
+	maxLines int
+	maxBytes int
+	policy   OverflowPolicy
+	// closed stops popping after the queue is empty,
+	// aborted makes pushing never block
+	closed, aborted bool
+	dropped         *DropCounter
+}
+
+// newLineQueue creates a queue, zero limit means no limit on it
+func newLineQueue(maxLines, maxBytes int, policy OverflowPolicy, dropped *DropCounter) *lineQueue {
+	q := &lineQueue{
+		maxLines: maxLines,
+		maxBytes: maxBytes,
+		policy:   policy,
+		dropped:  dropped,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *lineQueue) full(l *Line) bool {
+	if len(q.lines) == 0 {
+		// a line larger than maxBytes is still accepted by an empty queue
+		return false
+	}
+	return q.maxLines > 0 && len(q.lines) >= q.maxLines ||
+		q.maxBytes > 0 && q.bytes+len(l.Data) > q.maxBytes
+}
+
+// push appends the line, the overflow is handled by the policy
+func (q *lineQueue) push(l Line) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.dropped.add(&l)
+		return
+	}
+	for q.full(&l) {
+		switch {
+		case q.policy == Block && !q.aborted:
+			q.cond.Wait()
+			if q.closed {
+				q.dropped.add(&l)
+				return
+			}
+		case q.policy == DropOldest:
+			q.dropped.add(&q.lines[0])
+			q.bytes -= len(q.lines[0].Data)
+			q.lines[0] = Line{}
+			q.lines = q.lines[1:]
+		default:
+			q.dropped.add(&l)
+			return
+		}
+	}
+	q.lines = append(q.lines, l)
+	q.bytes += len(l.Data)
+	q.cond.Broadcast()
+}
+
+// pop removes the first line, it blocks until a line is pushed,
+// and returns false if the queue is closed and empty
+func (q *lineQueue) pop() (Line, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.lines) == 0 {
+		if q.closed {
+			return Line{}, false
+		}
+		q.cond.Wait()
+	}
+	l := q.lines[0]
+	q.lines[0] = Line{}
+	q.lines = q.lines[1:]
+	q.bytes -= len(l.Data)
+	q.cond.Broadcast()
+	return l, true
+}
+
+// discard drops the queued lines and returns the number of them
+func (q *lineQueue) discard() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.lines)
+	q.dropped.addN(uint64(n), uint64(q.bytes))
+	q.lines = nil
+	q.bytes = 0
+	q.cond.Broadcast()
+	return n
+}
+
+// close stops accepting lines, the queued lines can still be popped
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// abort makes the blocked and later pushes drop the lines instead of waiting
+func (q *lineQueue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
@@ -1,6 +1,9 @@
 package sink
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 // LogSink controls to start/stop log listening
 type LogSink interface {
@@ -12,3 +15,31 @@ type LogSink interface {
 type LogSinkFactory interface {
 	NewLogSink() LogSink
 }
+
+// LogTailer is implemented by the log sinks which keep the recent output of the process,
+// it's used to attach the output to crash reports
+type LogTailer interface {
+	// Tail returns the last n bytes of stdout and stderr,
+	// it's called after Stop and must return all output read before
+	Tail(n int) (stdout, stderr []byte)
+}
+
+// Line is a line of the process output
+type Line struct {
+	Stream Stream
+	Time   time.Time
+	// Source is the path of the log file which the line is tailed from,
+	// empty if the line is read from stdout or stderr
+	Source string
+	// Data is the content without the line break, it must not be modified
+	Data []byte
+}
+
+// LineWriter is implemented by the log sinks which can take the output line by line
+// instead of reading the pipes, so that the output read once can be shared by many sinks.
+// Such a sink is started with nil pipes, and WriteLine is called between Start and Stop
+type LineWriter interface {
+	// WriteLine handles a line, it may be called concurrently.
+	// The data is never reused by the caller, but it must not be modified since it's shared
+	WriteLine(l *Line)
+}
@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// spoolSuffix is the suffix of the spooled batch files
+const spoolSuffix = ".batch"
+
+// spoolEntry is an encoded batch waiting to be shipped
+type spoolEntry struct {
+	seq   uint64
+	lines uint64
+	bytes uint64
+	size  int64
+	// payload is nil if the batch is kept in a file
+	payload []byte
+}
+
+// logSpool keeps the batches failed to be shipped in order, in files if dir is set
+// or in memory otherwise. The oldest batches are dropped when it's larger than max
+type logSpool struct {
+	dir     string
+	max     int64
+	size    int64
+	seq     uint64
+	entries []*spoolEntry
+	dropped *DropCounter
+}
+
+// openLogSpool loads the batches left in the directory
+func openLogSpool(dir string, max int64, dropped *DropCounter) (*logSpool, error) {
+	s := &logSpool{dir: dir, max: max, dropped: dropped}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create spool directory [%s] failed", dir)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read spool directory [%s] failed", dir)
+	}
+	for _, fi := range fis {
+		e := &spoolEntry{size: fi.Size()}
+		_, err := fmt.Sscanf(fi.Name(), "%020d-%d-%d"+spoolSuffix, &e.seq, &e.lines, &e.bytes)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		s.entries = append(s.entries, e)
+		s.size += e.size
+		if e.seq >= s.seq {
+			s.seq = e.seq + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	return s, nil
+}
+
+func (s *logSpool) path(e *spoolEntry) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d-%d-%d"+spoolSuffix, e.seq, e.lines, e.bytes))
+}
+
+// empty returns true if there is no batch to ship
+func (s *logSpool) empty() bool {
+	return len(s.entries) == 0
+}
+
+// push appends the batch of the lines and bytes
+func (s *logSpool) push(payload []byte, lines, bytes uint64) error {
+	e := &spoolEntry{seq: s.seq, lines: lines, bytes: bytes, size: int64(len(payload))}
+	s.seq++
+	if s.dir == "" {
+		e.payload = payload
+	} else if err := ioutil.WriteFile(s.path(e), payload, 0644); err != nil {
+		os.Remove(s.path(e))
+		return errors.Wrap(err, "write spool file failed")
+	}
+	s.entries = append(s.entries, e)
+	s.size += e.size
+	for s.size > s.max && len(s.entries) > 1 {
+		s.dropped.addN(s.entries[0].lines, s.entries[0].bytes)
+		s.pop()
+	}
+	return nil
+}
+
+// peek returns the oldest batch
+func (s *logSpool) peek() ([]byte, error) {
+	e := s.entries[0]
+	if e.payload != nil {
+		return e.payload, nil
+	}
+	data, err := ioutil.ReadFile(s.path(e))
+	return data, errors.Wrap(err, "read spool file failed")
+}
+
+// replace replaces the oldest batch by the part of it left to ship
+func (s *logSpool) replace(payload []byte, lines, bytes uint64) error {
+	old := s.entries[0]
+	e := &spoolEntry{seq: old.seq, lines: lines, bytes: bytes, size: int64(len(payload))}
+	if s.dir == "" {
+		e.payload = payload
+	} else {
+		if err := ioutil.WriteFile(s.path(e), payload, 0644); err != nil {
+			os.Remove(s.path(e))
+			return errors.Wrap(err, "write spool file failed")
+		}
+		if s.path(e) != s.path(old) {
+			os.Remove(s.path(old))
+		}
+	}
+	s.entries[0] = e
+	s.size += e.size - old.size
+	return nil
+}
+
+// pop removes the oldest batch
+func (s *logSpool) pop() {
+	e := s.entries[0]
+	if s.dir != "" {
+		os.Remove(s.path(e))
+	}
+	s.entries[0] = nil
+	s.entries = s.entries[1:]
+	s.size -= e.size
+}
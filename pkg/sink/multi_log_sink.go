@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+)
+
+// teeQueueSize is the number of lines queued for each sink of MultiLogSink,
+// the oldest line is dropped if the sink falls behind
+const teeQueueSize = 4096
+
+// newTeeOutput creates the output of MultiLogSink to the sink
+func newTeeOutput(sink LogSink) *teeOutput {
+	return &teeOutput{
+		sink:  sink,
+		queue: newLineQueue(teeQueueSize, 0, DropOldest, &DropCounter{}),
+	}
+}
+
+// dropCounting is a log sink with queues, the lines dropped by them are counted to the counter
+type dropCounting interface {
+	countDrops(dropped *DropCounter)
+}
+
+// MultiLogSinkFactory duplicates the output of a process to the sinks created by several factories
+type MultiLogSinkFactory struct {
+	factories []LogSinkFactory
+}
+
+// NewMultiLogSinkFactory creates a log sink factory which tees the output to the factories
+func NewMultiLogSinkFactory(factories ...LogSinkFactory) *MultiLogSinkFactory {
+	return &MultiLogSinkFactory{factories: factories}
+}
+
+// NewLogSink creates a log sink which tees the output to a new sink of every factory
+func (f *MultiLogSinkFactory) NewLogSink() LogSink {
+	s := &MultiLogSink{}
+	for _, factory := range f.factories {
+		s.outputs = append(s.outputs, newTeeOutput(factory.NewLogSink()))
+	}
+	return s
+}
+
+// MultiLogSink reads the output of a process once and tees the lines to its sinks.
+// Every sink has its own queue and goroutine, a slow sink loses its oldest queued lines
+// instead of blocking the process or the other sinks
+type MultiLogSink struct {
+	reader pipeReader
+	// mu guards closing the queues against WriteLine
+	mu      sync.RWMutex
+	closed  bool
+	outputs []*teeOutput
+}
+
+// teeOutput delivers the lines to a sink, by WriteLine if the sink is a LineWriter,
+// or by the pipes created for it otherwise
+type teeOutput struct {
+	sink  LogSink
+	queue *lineQueue
+	donec chan struct{}
+	pipes []*os.File
+}
+
+func (o *teeOutput) start() error {
+	o.donec = make(chan struct{})
+	lw, ok := o.sink.(LineWriter)
+	if ok {
+		o.sink.Start(nil, nil)
+	} else {
+		prOut, pwOut, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		prErr, pwErr, err := os.Pipe()
+		if err != nil {
+			prOut.Close()
+			pwOut.Close()
+			return err
+		}
+		o.pipes = []*os.File{pwOut, pwErr}
+		o.sink.Start(prOut, prErr)
+	}
+	go func() {
+		defer close(o.donec)
+		for {
+			l, ok := o.queue.pop()
+			if !ok {
+				return
+			}
+			if lw != nil {
+				lw.WriteLine(&l)
+				continue
+			}
+			line := make([]byte, len(l.Data)+1)
+			copy(line, l.Data)
+			line[len(l.Data)] = '\n'
+			if _, err := o.pipes[l.Stream].Write(line); err != nil {
+				// the pipe is closed on stop timeout
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Start gets log sink to work
+func (s *MultiLogSink) Start(pout, perr *os.File) {
+	var started []*teeOutput
+	for i, o := range s.outputs {
+		if err := o.start(); err != nil {
+			log.Warnf("start log sink #%d failed: %v", i, err)
+			continue
+		}
+		started = append(started, o)
+	}
+	s.outputs = started
+	s.reader.start(pout, perr, func(st Stream, data []byte) {
+		s.WriteLine(&Line{
+			Stream: st,
+			Time:   time.Now(),
+			Data:   append([]byte(nil), bytes.TrimSuffix(data, []byte("\n"))...),
+		})
+	})
+}
+
+// WriteLine tees the line to all sinks, so that a MultiLogSink can be nested
+func (s *MultiLogSink) WriteLine(l *Line) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for _, o := range s.outputs {
+		o.queue.push(*l)
+	}
+}
+
+// Stop terminates log sink after the queued lines are delivered or logDrainTimeout,
+// then stops all sinks
+func (s *MultiLogSink) Stop() {
+	s.reader.stopOrAbort(func() {
+		// unblock the readers waiting for room
+		for _, o := range s.outputs {
+			o.queue.abort()
+		}
+	})
+	s.mu.Lock()
+	s.closed = true
+	for _, o := range s.outputs {
+		o.queue.close()
+	}
+	s.mu.Unlock()
+	deadline := time.Now().Add(logDrainTimeout)
+	for i, o := range s.outputs {
+		select {
+		case <-o.donec:
+		case <-time.After(time.Until(deadline)):
+			log.Warnf("log sink #%d is blocked, %d lines left are dropped", i, o.queue.discard())
+		}
+		for _, p := range o.pipes {
+			p.Close()
+		}
+	}
+	for _, o := range s.outputs {
+		o.sink.Stop()
+	}
+}
+
+// countDrops counts the lines dropped by the queues of the sink and its nested sinks to one counter
+func (s *MultiLogSink) countDrops(dropped *DropCounter) {
+	for _, o := range s.outputs {
+		o.queue.dropped = dropped
+		if c, ok := o.sink.(dropCounting); ok {
+			c.countDrops(dropped)
+		}
+	}
+}
+
+// Tail returns the output of the process kept by the first sink implementing LogTailer
+func (s *MultiLogSink) Tail(n int) ([]byte, []byte) {
+	for _, o := range s.outputs {
+		if t, ok := o.sink.(LogTailer); ok {
+			return t.Tail(n)
+		}
+	}
+	return nil, nil
+}
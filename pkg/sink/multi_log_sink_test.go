@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferLogSink reads the pipes into memory, it's not a LineWriter
+type bufferLogSink struct {
+	wg             sync.WaitGroup
+	stdout, stderr bytes.Buffer
+}
+
+func (s *bufferLogSink) Start(pout, perr *os.File) {
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		_, _ = io.Copy(&s.stdout, pout)
+	}()
+	go func() {
+		defer s.wg.Done()
+		_, _ = io.Copy(&s.stderr, perr)
+	}()
+}
+
+func (s *bufferLogSink) Stop() {
+	s.wg.Wait()
+}
+
+type bufferLogSinkFactory struct {
+	sinks []*bufferLogSink
+}
+
+func (f *bufferLogSinkFactory) NewLogSink() LogSink {
+	s := &bufferLogSink{}
+	f.sinks = append(f.sinks, s)
+	return s
+}
+
+// blockedLogSink blocks on writing until it's released
+type blockedLogSink struct {
+	DummyLogSink
+	releasec chan struct{}
+}
+
+func (s *blockedLogSink) WriteLine(l *Line) {
+	<-s.releasec
+}
+
+type blockedLogSinkFactory struct {
+	releasec chan struct{}
+}
+
+func (f *blockedLogSinkFactory) NewLogSink() LogSink {
+	return &blockedLogSink{releasec: f.releasec}
+}
+
+func TestMultiLogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_multi_log_sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file, err := NewFileLogSinkFactory(FileLogConfig{Dir: dir, Name: "tidb"})
+	assert.NoError(t, err)
+	ring := NewRingLogSinkFactory(RingLogConfig{})
+	buffer := &bufferLogSinkFactory{}
+	f := NewMultiLogSinkFactory(file, ring, buffer)
+
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString("out\n")
+	perr.WriteString("err\n")
+	pout.Close()
+	perr.Close()
+	s.Stop()
+	assert.NoError(t, file.Close())
+
+	assert.Equal(t, "out\n", readFile(t, filepath.Join(dir, "tidb.stdout.log")))
+	assert.Equal(t, "err\n", readFile(t, filepath.Join(dir, "tidb.stderr.log")))
+	assert.Len(t, ring.Tail(-1), 2)
+	assert.Equal(t, "out\n", buffer.sinks[0].stdout.String())
+	assert.Equal(t, "err\n", buffer.sinks[0].stderr.String())
+	// the output is kept by the ring buffer
+	stdout, stderr := s.(LogTailer).Tail(1024)
+	assert.Equal(t, "out\n", string(stdout))
+	assert.Equal(t, "err\n", string(stderr))
+}
+
+func TestMultiLogSinkBlocked(t *testing.T) {
+	ring := NewRingLogSinkFactory(RingLogConfig{MaxLines: 2 * teeQueueSize})
+	blocked := &blockedLogSinkFactory{releasec: make(chan struct{})}
+	defer close(blocked.releasec)
+	f := NewMultiLogSinkFactory(blocked, ring)
+
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	// the blocked sink doesn't block the writer and the other sinks
+	n := 2 * teeQueueSize
+	for i := 0; i < n; i++ {
+		pout.WriteString(strconv.Itoa(i) + "\n")
+	}
+	pout.Close()
+	perr.Close()
+	start := time.Now()
+	s.Stop()
+	assert.True(t, time.Since(start) < 3*logDrainTimeout)
+	lines := ring.Tail(1)
+	assert.Equal(t, strconv.Itoa(n-1), string(lines[0].Data))
+	dropped, _ := s.(*MultiLogSink).outputs[0].queue.dropped.Dropped()
+	assert.True(t, dropped > 0)
+}
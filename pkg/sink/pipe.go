@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// logDrainTimeout is the time to wait for the output left in the pipes after the process exits,
+	// the pipes may be kept open by the orphaned children
+	logDrainTimeout = 1 * time.Second
+	// maxLineSize is the max bytes of a line, longer lines are split
+	maxLineSize = 64 << 10
+)
+
+// Stream identifies the output stream of the process
+type Stream int
+
+// Enum values of the Stream type
+const (
+	Stdout Stream = iota
+	Stderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	default:
+		return "unknown"
+	}
+}
+
+// pipeReader reads the output of the process line by line
+type pipeReader struct {
+	wg    sync.WaitGroup
+	files []*os.File
+}
+
+// start reads the pipes in background, handle is called for each line including
+// the line break, it must not retain the line and must be safe for concurrent use.
+// The nil pipes are skipped
+func (r *pipeReader) start(pout, perr *os.File, handle func(s Stream, line []byte)) {
+	r.files = []*os.File{pout, perr}
+	for i, f := range r.files {
+		if f == nil {
+			continue
+		}
+		r.wg.Add(1)
+		go func(s Stream, f *os.File) {
+			defer r.wg.Done()
+			readLines(f, func(line []byte) {
+				handle(s, line)
+			})
+		}(Stream(i), f)
+	}
+}
+
+// stop waits for the pipes to be drained, the pipes are closed after logDrainTimeout
+func (r *pipeReader) stop() {
+	r.stopOrAbort(nil)
+}
+
+// stopOrAbort is like stop, but abort is called to unblock the line handler
+// if the pipes are not drained in time
+func (r *pipeReader) stopOrAbort(abort func()) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(logDrainTimeout):
+		if abort != nil {
+			abort()
+		}
+	}
+	for _, f := range r.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	<-done
+}
+
+func readLines(rd io.Reader, handle func(line []byte)) {
+	br := bufio.NewReaderSize(rd, maxLineSize)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			handle(line)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
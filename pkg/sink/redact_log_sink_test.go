@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(append(DefaultRedactRules, SQLLiteralRules...))
+	assert.NoError(t, err)
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"connect with password=abc123 failed", "connect with password=****** failed"},
+		{`{"passwd": "abc", "user": "root"}`, `{"passwd": "******", "user": "root"}`},
+		{"[token=xyz] [api_key:def]", "[token=******] [api_key:******]"},
+		{"dsn root:pass@tcp(127.0.0.1:4000)/test", "dsn root:******@tcp(127.0.0.1:4000)/test"},
+		{"pd url http://admin:pass@pd:2379/pd", "pd url http://admin:******@pd:2379/pd"},
+		{"Authorization: Bearer abc.def", "Authorization: Bearer ******"},
+		{"select * from t where name = 'alice' and a = 'it''s'", "select * from t where name = '?' and a = '?'"},
+		{"welcome to TiDB, tokens=5", "welcome to TiDB, tokens=5"},
+	}
+	for _, c := range cases {
+		data := []byte(c.line)
+		assert.Equal(t, c.expected, string(r.Redact(data)))
+		// the data is shared and never modified
+		assert.Equal(t, c.line, string(data))
+	}
+
+	r, err = NewRedactor([]RedactRule{{Literal: "s3cr3t"}, {Regexp: `\d{16}`, Replacement: "<card>"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "****** ****** <card>", string(r.Redact([]byte("s3cr3t s3cr3t 1234567812345678"))))
+
+	_, err = NewRedactor([]RedactRule{{}})
+	assert.Error(t, err)
+	_, err = NewRedactor([]RedactRule{{Regexp: "a", Literal: "a"}})
+	assert.Error(t, err)
+	_, err = NewRedactor([]RedactRule{{Regexp: "("}})
+	assert.Error(t, err)
+}
+
+func TestRedactLogSink(t *testing.T) {
+	r, err := NewRedactor(DefaultRedactRules)
+	assert.NoError(t, err)
+	ring := NewRingLogSinkFactory(RingLogConfig{})
+	buffer := &bufferLogSinkFactory{}
+	f := NewRedactLogSinkFactory(NewMultiLogSinkFactory(ring, buffer), r)
+
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString("password=abc\n")
+	perr.WriteString("root:abc@tcp(tidb:4000)/\n")
+	pout.Close()
+	perr.Close()
+	s.Stop()
+
+	// every sink gets the redacted lines
+	assert.ElementsMatch(t, []string{"stdout:password=******", "stderr:root:******@tcp(tidb:4000)/"}, lineData(ring.Tail(-1)))
+	assert.Equal(t, "password=******\n", buffer.sinks[0].stdout.String())
+	assert.Equal(t, "root:******@tcp(tidb:4000)/\n", buffer.sinks[0].stderr.String())
+}
+
+func TestRedactLogSinkInPlace(t *testing.T) {
+	r, err := NewRedactor(DefaultRedactRules)
+	assert.NoError(t, err)
+	ring := NewRingLogSinkFactory(RingLogConfig{})
+	s := NewRedactLogSinkFactory(ring, r).NewLogSink()
+	s.Start(nil, nil)
+	// the line reaches the sink when it's written, there is no queue in between
+	s.(LineWriter).WriteLine(&Line{Stream: Stdout, Data: []byte("token=abc")})
+	assert.Equal(t, []string{"stdout:token=******"}, lineData(ring.Tail(-1)))
+	s.Stop()
+
+	// a slow sink blocks the buffer instead of losing lines
+	gated := &gatedLogSinkFactory{gatec: make(chan struct{})}
+	f := NewBufferedLogSinkFactory(NewRedactLogSinkFactory(gated, r), BufferConfig{Policy: Block, MaxLines: 1})
+	s = f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	n := 1000
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(gated.gatec)
+	}()
+	for i := 0; i < n; i++ {
+		pout.WriteString("password=" + strconv.Itoa(i) + "\n")
+	}
+	pout.Close()
+	perr.Close()
+	s.Stop()
+	lines, _ := f.Dropped()
+	assert.Zero(t, lines)
+	assert.Len(t, gated.sinks[0].lines, n)
+	assert.Equal(t, "password=******", gated.sinks[0].lines[n-1])
+}
@@ -0,0 +1,577 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRemoteBatchLines    = 1000
+	defaultRemoteBatchBytes    = 1 << 20
+	defaultRemoteBatchInterval = 1 * time.Second
+	defaultRemoteTimeout       = 10 * time.Second
+	defaultRemoteQueueLines    = 10000
+	defaultRemoteSpoolSize     = 64 << 20
+	defaultRemoteIndex         = "tipervisor"
+	defaultRemoteBackoff       = 1 * time.Second
+	defaultRemoteMaxBackoff    = 1 * time.Minute
+	// maxBulkResponseSize bounds the response of the Elasticsearch bulk API,
+	// it has an item for every document
+	maxBulkResponseSize = 16 << 20
+)
+
+// RemoteProtocol is the protocol to ship the output with
+type RemoteProtocol int
+
+// Enum values of the RemoteProtocol type
+const (
+	// RemoteLoki pushes the lines to the Loki push API, e.g. http://loki:3100/loki/api/v1/push
+	RemoteLoki RemoteProtocol = iota
+	// RemoteElasticsearch indexes the lines by the Elasticsearch bulk API, e.g. http://es:9200/_bulk
+	RemoteElasticsearch
+	// RemoteTCP writes a JSON document per line to a TCP address
+	RemoteTCP
+)
+
+func (p RemoteProtocol) String() string {
+	switch p {
+	case RemoteLoki:
+		return "loki"
+	case RemoteElasticsearch:
+		return "elasticsearch"
+	case RemoteTCP:
+		return "tcp"
+	default:
+		return "unknown"
+	}
+}
+
+// RemoteLogConfig configures the shipping of a daemon's output to a remote log store
+type RemoteLogConfig struct {
+	// Name is the daemon name, it's sent as the daemon label
+	Name     string
+	Protocol RemoteProtocol
+	// URL is the endpoint of Loki or Elasticsearch
+	URL string
+	// Address is the host:port of RemoteTCP
+	Address string
+	// Index is the Elasticsearch index, default is tipervisor
+	Index string
+	// Labels are sent with every line, as Loki stream labels or document fields
+	Labels map[string]string
+	// BatchLines and BatchBytes ship the batch when it's full, default is 1000 lines and 1MB
+	BatchLines int
+	BatchBytes int
+	// BatchInterval ships the batch periodically even if it's not full, default is 1s
+	BatchInterval time.Duration
+	// Timeout is the time limit of shipping a batch, default is 10s
+	Timeout time.Duration
+	// InitialBackoff is the delay before the first retry, doubled after each failure
+	// up to MaxBackoff, default is 1s and 1m
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// QueueLines is the number of lines waiting for batching,
+	// the oldest lines are dropped if it's full, default is 10000
+	QueueLines int
+	// SpoolDir keeps the batches failed to be shipped until the remote is back,
+	// they're kept in memory if it's empty, and lost on exit
+	SpoolDir string
+	// SpoolSize is the max bytes of the spooled batches,
+	// the oldest batches are dropped if it's exceeded, default is 64MB
+	SpoolSize int64
+}
+
+// permanentError is returned by the remote which rejects the batch,
+// the batch is dropped instead of retried
+type permanentError struct {
+	error
+}
+
+// bulkError is returned by the Elasticsearch bulk API which fails some documents of the batch,
+// the rejected documents are dropped, and the ones failed by 429 or 5xx are retried
+type bulkError struct {
+	error
+	// retry is the payload of the documents to retry
+	retry                        []byte
+	retryLines, retryBytes       uint64
+	rejectedLines, rejectedBytes uint64
+}
+
+// RemoteLogSinkFactory ships the output of all processes of a daemon to a remote log store.
+// The lines are shipped in batches in a background goroutine, the failed batches
+// are spooled and retried with backoff, so the process is never blocked by the remote
+type RemoteLogSinkFactory struct {
+	cfg     RemoteLogConfig
+	queue   *lineQueue
+	spool   *logSpool
+	dropped DropCounter
+	client  *http.Client
+	conn    net.Conn
+	// backoff is the current retry delay, zero means the remote is available
+	backoff time.Duration
+	donec   chan struct{}
+}
+
+// NewRemoteLogSinkFactory checks the config and starts shipping,
+// the batches left in the spool directory are shipped first
+func NewRemoteLogSinkFactory(cfg RemoteLogConfig) (*RemoteLogSinkFactory, error) {
+	switch cfg.Protocol {
+	case RemoteLoki, RemoteElasticsearch:
+		if cfg.URL == "" {
+			return nil, errors.Errorf("url is required by %v", cfg.Protocol)
+		}
+	case RemoteTCP:
+		if cfg.Address == "" {
+			return nil, errors.New("address is required by tcp")
+		}
+	default:
+		return nil, errors.Errorf("unsupported remote protocol [%d]", cfg.Protocol)
+	}
+	if cfg.Index == "" {
+		cfg.Index = defaultRemoteIndex
+	}
+	if cfg.BatchLines <= 0 {
+		cfg.BatchLines = defaultRemoteBatchLines
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = defaultRemoteBatchBytes
+	}
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = defaultRemoteBatchInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRemoteTimeout
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultRemoteBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultRemoteMaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = cfg.InitialBackoff
+	}
+	if cfg.QueueLines <= 0 {
+		cfg.QueueLines = defaultRemoteQueueLines
+	}
+	if cfg.SpoolSize <= 0 {
+		cfg.SpoolSize = defaultRemoteSpoolSize
+	}
+	f := &RemoteLogSinkFactory{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		donec:  make(chan struct{}),
+	}
+	f.queue = newLineQueue(cfg.QueueLines, 0, DropOldest, &f.dropped)
+	var err error
+	if f.spool, err = openLogSpool(cfg.SpoolDir, cfg.SpoolSize, &f.dropped); err != nil {
+		return nil, err
+	}
+	go f.run()
+	return f, nil
+}
+
+// NewLogSink creates a log sink shipping to the remote
+func (f *RemoteLogSinkFactory) NewLogSink() LogSink {
+	return &RemoteLogSink{factory: f}
+}
+
+// Dropped returns the number of lines and bytes dropped
+// since the queue or the spool is full, or the remote rejects them
+func (f *RemoteLogSinkFactory) Dropped() (lines uint64, bytes uint64) {
+	return f.dropped.Dropped()
+}
+
+// Close ships the queued lines, the batches failed to be shipped
+// are kept in the spool directory for the next time
+func (f *RemoteLogSinkFactory) Close() error {
+	f.queue.close()
+	<-f.donec
+	if f.conn != nil {
+		return errors.Wrap(f.conn.Close(), "close remote connection failed")
+	}
+	return nil
+}
+
+func (f *RemoteLogSinkFactory) logger() *log.Entry {
+	return log.WithField("daemon", f.cfg.Name)
+}
+
+// run batches the queued lines and ships them until the queue is closed
+func (f *RemoteLogSinkFactory) run() {
+	defer close(f.donec)
+	linec := make(chan Line)
+	go func() {
+		defer close(linec)
+		for {
+			l, ok := f.queue.pop()
+			if !ok {
+				return
+			}
+			linec <- l
+		}
+	}()
+
+	var (
+		batch  []Line
+		size   int
+		retryc <-chan time.Time
+	)
+	ticker := time.NewTicker(f.cfg.BatchInterval)
+	defer ticker.Stop()
+	if !f.spool.empty() {
+		retryc = time.After(0)
+	}
+	for {
+		select {
+		case l, ok := <-linec:
+			if !ok {
+				if f.backoff == 0 {
+					f.retry()
+				}
+				f.ship(batch, true)
+				return
+			}
+			batch = append(batch, l)
+			size += len(l.Data)
+			if len(batch) < f.cfg.BatchLines && size < f.cfg.BatchBytes {
+				continue
+			}
+		case <-ticker.C:
+		case <-retryc:
+			retryc = nil
+			f.retry()
+		}
+		if len(batch) > 0 {
+			f.ship(batch, false)
+			batch, size = nil, 0
+		}
+		if f.backoff > 0 && retryc == nil {
+			retryc = time.After(f.backoff)
+		}
+	}
+}
+
+// ship sends the batch, or spools it if the remote is unavailable.
+// On closing, the batch is sent once and spooled on failure
+func (f *RemoteLogSinkFactory) ship(batch []Line, closing bool) {
+	if len(batch) == 0 {
+		return
+	}
+	var bytes uint64
+	for i := range batch {
+		bytes += uint64(len(batch[i].Data))
+	}
+	payload, err := f.encode(batch)
+	if err != nil {
+		f.logger().Warnf("encode log batch failed: %v", err)
+		f.dropped.addN(uint64(len(batch)), bytes)
+		return
+	}
+	lines := uint64(len(batch))
+	// keep the order if there are batches waiting for retry
+	if f.spool.empty() && (f.backoff == 0 || closing) {
+		err = f.send(payload)
+		switch e := err.(type) {
+		case nil:
+			return
+		case permanentError:
+			f.logger().Warnf("remote rejects %d lines: %v", lines, err)
+			f.dropped.addN(lines, bytes)
+			return
+		case bulkError:
+			f.logger().Warnf("remote rejects %d and fails %d of %d lines: %v", e.rejectedLines, e.retryLines, lines, err)
+			f.dropped.addN(e.rejectedLines, e.rejectedBytes)
+			if e.retryLines == 0 {
+				return
+			}
+			payload, lines, bytes = e.retry, e.retryLines, e.retryBytes
+		default:
+			f.logger().Warnf("ship %d lines failed: %v", lines, err)
+		}
+		f.fail()
+	}
+	if err = f.spool.push(payload, lines, bytes); err != nil {
+		f.logger().Warnf("spool %d lines failed: %v", lines, err)
+		f.dropped.addN(lines, bytes)
+	}
+}
+
+// retry sends the spooled batches in order until one fails
+func (f *RemoteLogSinkFactory) retry() {
+	for !f.spool.empty() {
+		entry := f.spool.entries[0]
+		payload, err := f.spool.peek()
+		if err != nil {
+			// the batch can never be shipped, skip it
+			f.logger().Warnf("drop unreadable spooled log batch: %v", err)
+			f.dropped.addN(entry.lines, entry.bytes)
+			f.spool.pop()
+			continue
+		}
+		err = f.send(payload)
+		switch e := err.(type) {
+		case nil:
+		case permanentError:
+			f.logger().Warnf("remote rejects spooled log batch: %v", err)
+			f.dropped.addN(entry.lines, entry.bytes)
+		case bulkError:
+			f.logger().Warnf("remote rejects %d and fails %d lines of spooled log batch: %v", e.rejectedLines, e.retryLines, err)
+			f.dropped.addN(e.rejectedLines, e.rejectedBytes)
+			if e.retryLines == 0 {
+				break
+			}
+			// keep the failed documents at the head to retry
+			if err = f.spool.replace(e.retry, e.retryLines, e.retryBytes); err == nil {
+				f.fail()
+				return
+			}
+			f.logger().Warnf("spool %d lines failed: %v", e.retryLines, err)
+			f.dropped.addN(e.retryLines, e.retryBytes)
+		default:
+			f.logger().Warnf("ship spooled log batch failed: %v", err)
+			f.fail()
+			return
+		}
+		f.spool.pop()
+	}
+	f.backoff = 0
+}
+
+// fail doubles the retry delay
+func (f *RemoteLogSinkFactory) fail() {
+	if f.backoff == 0 {
+		f.backoff = f.cfg.InitialBackoff
+	} else if f.backoff *= 2; f.backoff > f.cfg.MaxBackoff {
+		f.backoff = f.cfg.MaxBackoff
+	}
+}
+
+// labels returns the labels of the line, the file label is set if it's tailed from a log file
+func (f *RemoteLogSinkFactory) labels(l *Line) map[string]string {
+	labels := map[string]string{"daemon": f.cfg.Name, "stream": l.Stream.String()}
+	if l.Source != "" {
+		labels["file"] = l.Source
+	}
+	for k, v := range f.cfg.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// document returns the JSON document of the line for Elasticsearch and TCP
+func (f *RemoteLogSinkFactory) document(l *Line) ([]byte, error) {
+	doc := map[string]string{"@timestamp": l.Time.UTC().Format(time.RFC3339Nano), "message": string(l.Data)}
+	for k, v := range f.labels(l) {
+		doc[k] = v
+	}
+	return json.Marshal(doc)
+}
+
+// encode returns the payload of the batch in the format of the protocol
+func (f *RemoteLogSinkFactory) encode(batch []Line) ([]byte, error) {
+	var b bytes.Buffer
+	switch f.cfg.Protocol {
+	case RemoteLoki:
+		type lokiStream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		type streamKey struct {
+			stream Stream
+			source string
+		}
+		var req struct {
+			Streams []*lokiStream `json:"streams"`
+		}
+		streams := make(map[streamKey]*lokiStream)
+		for i := range batch {
+			l := &batch[i]
+			key := streamKey{l.Stream, l.Source}
+			st, ok := streams[key]
+			if !ok {
+				st = &lokiStream{Stream: f.labels(l)}
+				streams[key] = st
+				req.Streams = append(req.Streams, st)
+			}
+			st.Values = append(st.Values, [2]string{strconv.FormatInt(l.Time.UnixNano(), 10), string(l.Data)})
+		}
+		return json.Marshal(&req)
+	case RemoteElasticsearch:
+		action, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": f.cfg.Index}})
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			doc, err := f.document(&batch[i])
+			if err != nil {
+				return nil, err
+			}
+			b.Write(action)
+			b.WriteByte('\n')
+			b.Write(doc)
+			b.WriteByte('\n')
+		}
+	default:
+		for i := range batch {
+			doc, err := f.document(&batch[i])
+			if err != nil {
+				return nil, err
+			}
+			b.Write(doc)
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// send ships the payload
+func (f *RemoteLogSinkFactory) send(payload []byte) error {
+	if f.cfg.Protocol == RemoteTCP {
+		return f.sendTCP(payload)
+	}
+	ctype := "application/json"
+	if f.cfg.Protocol == RemoteElasticsearch {
+		ctype = "application/x-ndjson"
+	}
+	resp, err := f.client.Post(f.cfg.URL, ctype, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrapf(err, "post to [%s] failed", f.cfg.URL)
+	}
+	defer resp.Body.Close()
+	limit := int64(4096)
+	if f.cfg.Protocol == RemoteElasticsearch && resp.StatusCode < http.StatusMultipleChoices {
+		limit = maxBulkResponseSize
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		err = errors.Errorf("post to [%s] returns unexpected status [%s]: %s", f.cfg.URL, resp.Status, body)
+		// the batch can't be accepted by retrying
+		if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode < http.StatusInternalServerError &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	if f.cfg.Protocol == RemoteElasticsearch {
+		return f.bulkResult(payload, body)
+	}
+	return nil
+}
+
+// bulkResult checks the statuses of the documents in the response of the bulk API,
+// the whole batch is retried if the failed documents can't be told from the response,
+// e.g. it's truncated
+func (f *RemoteLogSinkFactory) bulkResult(payload, body []byte) error {
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return errors.Wrapf(err, "bulk index to [%s] failed: invalid response", f.cfg.URL)
+	}
+	if !result.Errors {
+		return nil
+	}
+	// every document is an action line followed by the document line
+	docs := bytes.SplitAfter(payload, []byte("\n"))
+	if len(result.Items)*2 != len(docs)-1 {
+		return errors.Errorf("bulk index to [%s] failed: %d items for %d documents", f.cfg.URL, len(result.Items), (len(docs)-1)/2)
+	}
+	e := bulkError{}
+	var reason json.RawMessage
+	for i, item := range result.Items {
+		for _, r := range item {
+			if r.Status < http.StatusMultipleChoices {
+				continue
+			}
+			if reason == nil {
+				reason = r.Error
+			}
+			action, doc := docs[2*i], docs[2*i+1]
+			n := messageSize(doc)
+			if r.Status == http.StatusTooManyRequests || r.Status >= http.StatusInternalServerError {
+				e.retry = append(append(e.retry, action...), doc...)
+				e.retryLines++
+				e.retryBytes += n
+			} else {
+				e.rejectedLines++
+				e.rejectedBytes += n
+			}
+		}
+	}
+	e.error = errors.Errorf("bulk index to [%s] failed: %s", f.cfg.URL, reason)
+	return e
+}
+
+// messageSize returns the size of the line in the document
+func messageSize(doc []byte) uint64 {
+	var d struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(doc, &d)
+	return uint64(len(d.Message))
+}
+
+// sendTCP writes the payload to the connection, it reconnects if the connection is broken
+func (f *RemoteLogSinkFactory) sendTCP(payload []byte) error {
+	if f.conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), f.cfg.Timeout)
+		defer cancel()
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", f.cfg.Address)
+		if err != nil {
+			return errors.Wrapf(err, "connect to [%s] failed", f.cfg.Address)
+		}
+		f.conn = conn
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(f.cfg.Timeout))
+	if _, err := f.conn.Write(payload); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		return errors.Wrapf(err, "write to [%s] failed", f.cfg.Address)
+	}
+	return nil
+}
+
+// RemoteLogSink ships the output of a process to the remote
+type RemoteLogSink struct {
+	factory *RemoteLogSinkFactory
+	reader  pipeReader
+}
+
+// Start gets log sink to work
+func (s *RemoteLogSink) Start(pout, perr *os.File) {
+	s.reader.start(pout, perr, func(st Stream, data []byte) {
+		s.WriteLine(&Line{
+			Stream: st,
+			Time:   time.Now(),
+			Data:   append([]byte(nil), bytes.TrimSuffix(data, []byte("\n"))...),
+		})
+	})
+}
+
+// WriteLine queues the line for shipping, it never blocks
+func (s *RemoteLogSink) WriteLine(l *Line) {
+	s.factory.queue.push(*l)
+}
+
+// Stop terminates log sink after the output is drained,
+// the queued lines are still shipped in background
+func (s *RemoteLogSink) Stop() {
+	s.reader.stop()
+}
@@ -0,0 +1,342 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// remoteServer records the requests, the first failures requests fail with the status,
+// the accepted requests get the responses in order, then the response
+type remoteServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	bodies    []string
+	ctypes    []string
+	failures  int
+	status    int
+	responses []string
+	response  string
+}
+
+func newRemoteServer() *remoteServer {
+	s := &remoteServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(s.status)
+			return
+		}
+		s.bodies = append(s.bodies, string(body))
+		s.ctypes = append(s.ctypes, r.Header.Get("Content-Type"))
+		if len(s.responses) > 0 {
+			w.Write([]byte(s.responses[0]))
+			s.responses = s.responses[1:]
+			return
+		}
+		w.Write([]byte(s.response))
+	}))
+	return s
+}
+
+func (s *remoteServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func writeRemoteLines(t *testing.T, f *RemoteLogSinkFactory, lines ...string) {
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	for _, l := range lines {
+		pout.WriteString(l + "\n")
+	}
+	pout.Close()
+	perr.Close()
+	s.Stop()
+}
+
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+func TestRemoteLogLoki(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		Name:          "tidb",
+		URL:           server.URL,
+		Labels:        map[string]string{"cluster": "test"},
+		BatchLines:    2,
+		BatchInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b", "c")
+	assert.NoError(t, f.Close())
+
+	// a full batch and the one flushed on close
+	bodies := server.requests()
+	assert.Len(t, bodies, 2)
+	var values []string
+	for _, body := range bodies {
+		var req lokiPush
+		assert.NoError(t, json.Unmarshal([]byte(body), &req))
+		assert.Len(t, req.Streams, 1)
+		assert.Equal(t, map[string]string{"daemon": "tidb", "stream": "stdout", "cluster": "test"}, req.Streams[0].Stream)
+		for _, v := range req.Streams[0].Values {
+			assert.NotEmpty(t, v[0])
+			values = append(values, v[1])
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, values)
+	assert.Equal(t, "application/json", server.ctypes[0])
+}
+
+func TestRemoteLogElasticsearch(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	server.response = `{"errors":false}`
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		Name:          "tikv",
+		Protocol:      RemoteElasticsearch,
+		URL:           server.URL + "/_bulk",
+		Index:         "logs",
+		BatchInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b")
+	assert.NoError(t, f.Close())
+
+	body := strings.Join(server.requests(), "")
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, `{"index":{"_index":"logs"}}`, lines[0])
+	var doc map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &doc))
+	assert.Equal(t, "b", doc["message"])
+	assert.Equal(t, "tikv", doc["daemon"])
+	assert.Equal(t, "stdout", doc["stream"])
+	_, err = time.Parse(time.RFC3339Nano, doc["@timestamp"])
+	assert.NoError(t, err)
+	assert.Equal(t, "application/x-ndjson", server.ctypes[0])
+}
+
+func TestRemoteLogBulkErrors(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	server.responses = []string{`{"errors":true,"items":[` +
+		`{"index":{"status":201}},` +
+		`{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},` +
+		`{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`}
+	server.response = `{"errors":false}`
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		Protocol:       RemoteElasticsearch,
+		URL:            server.URL + "/_bulk",
+		BatchLines:     3,
+		BatchInterval:  time.Hour,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "bb", "ccc")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.requests()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, f.Close())
+	// only the document failed by 429 is resent, the one rejected by 400 is dropped
+	bodies := server.requests()
+	assert.Len(t, bodies, 2)
+	lines := strings.Split(strings.TrimSuffix(bodies[1], "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"message":"bb"`)
+	dropped, bytes := f.Dropped()
+	assert.Equal(t, uint64(1), dropped)
+	assert.Equal(t, uint64(3), bytes)
+}
+
+func TestRemoteLogBulkInvalidResponse(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	// the response is truncated
+	server.responses = []string{`{"errors":true,"items":[{"index":{"status":201}},`}
+	server.response = `{"errors":false}`
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		Protocol:       RemoteElasticsearch,
+		URL:            server.URL + "/_bulk",
+		BatchLines:     2,
+		BatchInterval:  time.Hour,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.requests()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, f.Close())
+	// the whole batch is resent
+	bodies := server.requests()
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, bodies[0], bodies[1])
+	dropped, _ := f.Dropped()
+	assert.Equal(t, uint64(0), dropped)
+}
+
+func TestRemoteLogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		Name:     "pd",
+		Protocol: RemoteTCP,
+		Address:  l.Addr().String(),
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b")
+	assert.NoError(t, f.Close())
+
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"a", "b"} {
+		line, err := r.ReadBytes('\n')
+		assert.NoError(t, err)
+		var doc map[string]string
+		assert.NoError(t, json.Unmarshal(line, &doc))
+		assert.Equal(t, expected, doc["message"])
+		assert.Equal(t, "pd", doc["daemon"])
+	}
+}
+
+func TestRemoteLogRetry(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	server.failures = 3
+	server.status = http.StatusServiceUnavailable
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{
+		URL:            server.URL,
+		BatchLines:     1,
+		BatchInterval:  time.Hour,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b", "c")
+	// the spooled batches are shipped in order after the remote is back
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.requests()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, f.Close())
+	var values []string
+	for _, body := range server.requests() {
+		var req lokiPush
+		assert.NoError(t, json.Unmarshal([]byte(body), &req))
+		values = append(values, req.Streams[0].Values[0][1])
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, values)
+	lines, _ := f.Dropped()
+	assert.Zero(t, lines)
+}
+
+func TestRemoteLogSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_remote_log_spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the remote is down, the batches are kept in the spool directory
+	server := newRemoteServer()
+	server.failures = 100
+	server.status = http.StatusBadGateway
+	cfg := RemoteLogConfig{
+		URL:            server.URL,
+		BatchLines:     1,
+		BatchInterval:  time.Hour,
+		InitialBackoff: time.Hour,
+		SpoolDir:       dir,
+		SpoolSize:      200,
+	}
+	f, err := NewRemoteLogSinkFactory(cfg)
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "b", "c", "d", "e", "f")
+	assert.NoError(t, f.Close())
+	server.Close()
+	// the oldest batches are dropped to keep the spool small
+	lines, bytes := f.Dropped()
+	assert.True(t, lines > 0)
+	assert.Equal(t, lines, bytes)
+	fis, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 6-int(lines), len(fis))
+
+	// the spooled batches are shipped on the next start
+	server = newRemoteServer()
+	defer server.Close()
+	cfg.URL = server.URL
+	f, err = NewRemoteLogSinkFactory(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	bodies := server.requests()
+	assert.Len(t, bodies, len(fis))
+	assert.Contains(t, bodies[len(bodies)-1], `"f"`)
+	fis, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+}
+
+func TestRemoteLogUnreadableSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_remote_log_unreadable_spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the oldest spooled batch can't be read, the next one is still shipped
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "00000000000000000000-2-3.batch")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000001-1-1.batch"), []byte(`{"streams":[]}`), 0644))
+
+	server := newRemoteServer()
+	defer server.Close()
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{URL: server.URL, BatchInterval: time.Hour, SpoolDir: dir})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []string{`{"streams":[]}`}, server.requests())
+	lines, bytes := f.Dropped()
+	assert.Equal(t, uint64(2), lines)
+	assert.Equal(t, uint64(3), bytes)
+}
+
+func TestRemoteLogRejected(t *testing.T) {
+	server := newRemoteServer()
+	defer server.Close()
+	server.failures = 1
+	server.status = http.StatusBadRequest
+	f, err := NewRemoteLogSinkFactory(RemoteLogConfig{URL: server.URL, BatchInterval: time.Hour})
+	assert.NoError(t, err)
+	writeRemoteLines(t, f, "a", "bc")
+	assert.NoError(t, f.Close())
+	// the rejected batch is dropped instead of retried
+	assert.Empty(t, server.requests())
+	lines, bytes := f.Dropped()
+	assert.Equal(t, uint64(2), lines)
+	assert.Equal(t, uint64(3), bytes)
+
+	_, err = NewRemoteLogSinkFactory(RemoteLogConfig{Protocol: RemoteTCP})
+	assert.Error(t, err)
+	_, err = NewRemoteLogSinkFactory(RemoteLogConfig{Protocol: RemoteLoki})
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRingMaxLines = 1000
+	// ringFiles is the ring of the lines tailed from log files, after the rings of the streams
+	ringFiles = 2
+	// followBufferSize is the number of lines buffered for each follower,
+	// the oldest line is dropped if a follower falls behind
+	followBufferSize = 1024
+)
+
+// RingLogConfig limits the output kept in memory for each stream and the tailed log files,
+// the oldest lines are dropped when either limit is exceeded. The lines of the files are kept
+// apart, so that they never evict the output of the process needed by the crash reports
+type RingLogConfig struct {
+	// MaxLines is the number of lines, default is 1000 if MaxBytes is not set
+	MaxLines int
+	// MaxBytes is the total size of lines, zero means no limit
+	MaxBytes int
+}
+
+type ringLine struct {
+	Line
+	seq uint64
+}
+
+type ringStream struct {
+	lines []ringLine
+	bytes int
+}
+
+// RingLogSinkFactory keeps the recent output of all processes of a daemon in memory
+type RingLogSinkFactory struct {
+	cfg       RingLogConfig
+	mu        sync.Mutex
+	seq       uint64
+	streams   [3]ringStream
+	followers map[chan Line]struct{}
+}
+
+// NewRingLogSinkFactory creates a ring buffer log sink factory
+func NewRingLogSinkFactory(cfg RingLogConfig) *RingLogSinkFactory {
+	if cfg.MaxLines <= 0 && cfg.MaxBytes <= 0 {
+		cfg.MaxLines = defaultRingMaxLines
+	}
+	return &RingLogSinkFactory{
+		cfg:       cfg,
+		followers: make(map[chan Line]struct{}),
+	}
+}
+
+// NewLogSink creates a log sink writing to the ring buffer
+func (f *RingLogSinkFactory) NewLogSink() LogSink {
+	return &RingLogSink{factory: f}
+}
+
+// write appends the line read from the pipe to the ring buffer
+func (f *RingLogSinkFactory) write(s Stream, data []byte) {
+	f.add(Line{
+		Stream: s,
+		Time:   time.Now(),
+		Data:   append([]byte(nil), bytes.TrimSuffix(data, []byte("\n"))...),
+	})
+}
+
+// add appends the line to the ring buffer and sends it to the followers, the line is retained
+func (f *RingLogSinkFactory) add(l Line) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	rs := &f.streams[l.Stream]
+	if l.Source != "" {
+		rs = &f.streams[ringFiles]
+	}
+	rs.lines = append(rs.lines, ringLine{Line: l, seq: f.seq})
+	rs.bytes += len(l.Data)
+	for len(rs.lines) > 1 && (f.cfg.MaxLines > 0 && len(rs.lines) > f.cfg.MaxLines ||
+		f.cfg.MaxBytes > 0 && rs.bytes > f.cfg.MaxBytes) {
+		rs.bytes -= len(rs.lines[0].Data)
+		rs.lines[0] = ringLine{}
+		rs.lines = rs.lines[1:]
+	}
+	for ch := range f.followers {
+		sendLineDropOldest(ch, l)
+	}
+}
+
+// since returns the lines of both streams and the files after the sequence in order
+func (f *RingLogSinkFactory) since(seq uint64) []ringLine {
+	var (
+		rings [len(f.streams)][]ringLine
+		total int
+	)
+	for i := range f.streams {
+		rings[i] = f.streams[i].lines
+		total += len(rings[i])
+	}
+	lines := make([]ringLine, 0, total)
+	for {
+		next := -1
+		for i := range rings {
+			if len(rings[i]) > 0 && (next < 0 || rings[i][0].seq < rings[next][0].seq) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return lines
+		}
+		l := rings[next][0]
+		rings[next] = rings[next][1:]
+		if l.seq > seq {
+			lines = append(lines, l)
+		}
+	}
+}
+
+func (f *RingLogSinkFactory) tail(n int) []Line {
+	rls := f.since(0)
+	if n >= 0 && len(rls) > n {
+		rls = rls[len(rls)-n:]
+	}
+	lines := make([]Line, len(rls))
+	for i, rl := range rls {
+		lines[i] = rl.Line
+	}
+	return lines
+}
+
+// Tail returns the last n lines of stdout, stderr and the files in order, negative n means all
+func (f *RingLogSinkFactory) Tail(n int) []Line {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tail(n)
+}
+
+// Follow returns a channel receiving the last n lines and the new lines after,
+// the channel is closed when ctx is done. A follower which falls behind
+// loses the oldest lines in its buffer instead of blocking the output
+func (f *RingLogSinkFactory) Follow(ctx context.Context, n int) <-chan Line {
+	ch := make(chan Line, followBufferSize)
+	f.mu.Lock()
+	for _, l := range f.tail(n) {
+		sendLineDropOldest(ch, l)
+	}
+	f.followers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.followers, ch)
+		close(ch)
+		f.mu.Unlock()
+	}()
+	return ch
+}
+
+// sendLineDropOldest sends the line to the channel, drops the oldest line if the channel is full
+func sendLineDropOldest(ch chan Line, l Line) {
+	for {
+		select {
+		case ch <- l:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// RingLogSink writes the output of a process to the ring buffer of its factory,
+// it implements LogTailer to return the output of the process
+type RingLogSink struct {
+	factory *RingLogSinkFactory
+	reader  pipeReader
+	// the output of the process is in (startSeq, endSeq], endSeq is set when stopped
+	startSeq uint64
+	endSeq   uint64
+	stopped  bool
+}
+
+// Start gets log sink to work
+func (s *RingLogSink) Start(pout, perr *os.File) {
+	s.factory.mu.Lock()
+	s.startSeq = s.factory.seq
+	s.factory.mu.Unlock()
+	s.reader.start(pout, perr, s.factory.write)
+}
+
+// WriteLine appends the line to the ring buffer
+func (s *RingLogSink) WriteLine(l *Line) {
+	s.factory.add(*l)
+}
+
+// Stop terminates log sink after the output is drained
+func (s *RingLogSink) Stop() {
+	s.reader.stop()
+	s.factory.mu.Lock()
+	s.endSeq = s.factory.seq
+	s.stopped = true
+	s.factory.mu.Unlock()
+}
+
+// Tail returns the last n bytes of stdout and stderr of the process which are still kept,
+// the lines tailed from log files are excluded
+func (s *RingLogSink) Tail(n int) ([]byte, []byte) {
+	s.factory.mu.Lock()
+	defer s.factory.mu.Unlock()
+	var out [2][]byte
+	for _, l := range s.factory.since(s.startSeq) {
+		if s.stopped && l.seq > s.endSeq {
+			// the output of the next process
+			break
+		}
+		if l.Source != "" {
+			continue
+		}
+		out[l.Stream] = append(append(out[l.Stream], l.Data...), '\n')
+	}
+	for i := range out {
+		if len(out[i]) > n {
+			out[i] = out[i][len(out[i])-n:]
+		}
+	}
+	return out[Stdout], out[Stderr]
+}
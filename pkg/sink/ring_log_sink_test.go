@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lineData(lines []Line) []string {
+	var data []string
+	for _, l := range lines {
+		data = append(data, l.Stream.String()+":"+string(l.Data))
+	}
+	return data
+}
+
+func TestRingLogSink(t *testing.T) {
+	f := NewRingLogSinkFactory(RingLogConfig{MaxLines: 2})
+	f.write(Stdout, []byte("out 0\n"))
+	f.write(Stderr, []byte("err 0\n"))
+
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString("out 1\n")
+	time.Sleep(10 * time.Millisecond)
+	perr.WriteString("err 1\n")
+	time.Sleep(10 * time.Millisecond)
+	pout.WriteString("out 2\n")
+	pout.Close()
+	perr.Close()
+	s.Stop()
+
+	// the last two lines of each stream are kept
+	assert.Equal(t, []string{"stderr:err 0", "stdout:out 1", "stderr:err 1", "stdout:out 2"}, lineData(f.Tail(-1)))
+	assert.Equal(t, []string{"stderr:err 1", "stdout:out 2"}, lineData(f.Tail(2)))
+	// only the output of the process is returned
+	stdout, stderr := s.(LogTailer).Tail(1024)
+	assert.Equal(t, "out 1\nout 2\n", string(stdout))
+	assert.Equal(t, "err 1\n", string(stderr))
+	stdout, _ = s.(LogTailer).Tail(6)
+	assert.Equal(t, "out 2\n", string(stdout))
+
+	// the output of the restarted process isn't returned
+	next := f.NewLogSink()
+	next.Start(nil, nil)
+	next.(LineWriter).WriteLine(&Line{Stream: Stdout, Data: []byte("out 3")})
+	stdout, _ = s.(LogTailer).Tail(1024)
+	assert.Equal(t, "out 2\n", string(stdout))
+	next.Stop()
+	stdout, _ = next.(LogTailer).Tail(1024)
+	assert.Equal(t, "out 3\n", string(stdout))
+}
+
+func TestRingLogFiles(t *testing.T) {
+	f := NewRingLogSinkFactory(RingLogConfig{MaxLines: 2})
+	s := f.NewLogSink()
+	s.Start(nil, nil)
+	lw := s.(LineWriter)
+	lw.WriteLine(&Line{Stream: Stdout, Data: []byte("out 0")})
+	lw.WriteLine(&Line{Stream: Stdout, Data: []byte("out 1")})
+	// the lines of the files never evict the output of the process
+	for i := 0; i < 3; i++ {
+		lw.WriteLine(&Line{Stream: Stdout, Source: "tidb.log", Data: []byte("file " + strconv.Itoa(i))})
+	}
+	s.Stop()
+	assert.Equal(t, []string{"stdout:out 0", "stdout:out 1", "stdout:file 1", "stdout:file 2"}, lineData(f.Tail(-1)))
+	stdout, _ := s.(LogTailer).Tail(1024)
+	assert.Equal(t, "out 0\nout 1\n", string(stdout))
+}
+
+func TestRingLogMaxBytes(t *testing.T) {
+	f := NewRingLogSinkFactory(RingLogConfig{MaxBytes: 10})
+	for _, l := range []string{"12345", "678", "90", "abcdefghijklmn"} {
+		f.write(Stdout, []byte(l))
+	}
+	assert.Equal(t, []string{"stdout:abcdefghijklmn"}, lineData(f.Tail(-1)))
+	f.write(Stdout, []byte("x"))
+	assert.Equal(t, []string{"stdout:x"}, lineData(f.Tail(-1)))
+}
+
+func TestRingLogFollow(t *testing.T) {
+	f := NewRingLogSinkFactory(RingLogConfig{})
+	f.write(Stdout, []byte("line 0\n"))
+	f.write(Stdout, []byte("line 1\n"))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := f.Follow(ctx, 1)
+	f.write(Stderr, []byte("line 2\n"))
+	assert.Equal(t, "line 1", string((<-ch).Data))
+	l := <-ch
+	assert.Equal(t, "line 2", string(l.Data))
+	assert.Equal(t, Stderr, l.Stream)
+	cancel()
+	for range ch {
+	}
+
+	// slow followers lose the oldest lines
+	ch = f.Follow(context.Background(), 0)
+	for i := 0; i < followBufferSize+1; i++ {
+		f.write(Stdout, []byte("line"))
+	}
+	assert.Len(t, ch, followBufferSize)
+}
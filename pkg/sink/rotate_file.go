@@ -0,0 +1,238 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// backupTimeFormat is the suffix of rotated files, they sort by time
+const backupTimeFormat = "20060102T150405.000000000"
+
+// rotateRetryInterval is the delay before rotating the file again after a failure
+const rotateRetryInterval = time.Minute
+
+// renameFile renames the rotated file, it's replaced in tests
+var renameFile = os.Rename
+
+// rotateFile is a log file rotated by size and time
+type rotateFile struct {
+	mu       sync.Mutex
+	path     string
+	cfg      *FileLogConfig
+	uid, gid int
+	file     *os.File
+	size     int64
+	openTime time.Time
+	closed   bool
+	// retryTime is when to rotate again after the last rotation failed
+	retryTime time.Time
+	// bgMu serializes compressing and pruning the rotated files in background
+	bgMu sync.Mutex
+	bgWg sync.WaitGroup
+}
+
+func openRotateFile(path string, cfg *FileLogConfig, uid, gid int) (*rotateFile, error) {
+	f := &rotateFile{
+		path: path,
+		cfg:  cfg,
+		uid:  uid,
+		gid:  gid,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open log file [%s] failed", f.path)
+	}
+	if err = f.chown(f.path); err != nil {
+		file.Close()
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "stat log file [%s] failed", f.path)
+	}
+	f.file = file
+	f.size = fi.Size()
+	f.openTime = time.Now()
+	return nil
+}
+
+func (f *rotateFile) chown(path string) error {
+	if f.uid < 0 && f.gid < 0 {
+		return nil
+	}
+	return errors.Wrapf(os.Chown(path, f.uid, f.gid), "change owner of log file [%s] failed", path)
+}
+
+// Write writes the data to the file, the file is rotated before writing
+// if it would exceed MaxSize or it has been written for RotateInterval
+func (f *rotateFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errors.Errorf("log file [%s] is closed", f.path)
+	}
+	if f.file == nil {
+		// the file failed to be opened in the last rotation
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.needRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, errors.Wrapf(err, "write log file [%s] failed", f.path)
+}
+
+func (f *rotateFile) needRotate(n int) bool {
+	if f.size == 0 || time.Now().Before(f.retryTime) {
+		return false
+	}
+	if f.cfg.MaxSize > 0 && f.size+int64(n) > f.cfg.MaxSize {
+		return true
+	}
+	return f.cfg.RotateInterval > 0 && time.Since(f.openTime) >= f.cfg.RotateInterval
+}
+
+// rotate renames the current file to a backup and opens a new one,
+// if it fails to rename, it keeps appending to the current file and retries later
+func (f *rotateFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		log.Warnf("close log file [%s] failed: %v", f.path, err)
+	}
+	f.file = nil
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := renameFile(f.path, backup); err != nil {
+		log.Warnf("rotate log file [%s] failed, retry in %v: %v", f.path, rotateRetryInterval, err)
+		f.retryTime = time.Now().Add(rotateRetryInterval)
+		return f.open()
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.bgWg.Add(1)
+	go func() {
+		defer f.bgWg.Done()
+		f.bgMu.Lock()
+		defer f.bgMu.Unlock()
+		if f.cfg.Compress {
+			if err := f.compress(backup); err != nil {
+				log.Warnf("%+v", err)
+			}
+		}
+		if err := f.prune(); err != nil {
+			log.Warnf("%+v", err)
+		}
+	}()
+	return nil
+}
+
+// compress gzips the rotated file and removes the original one
+func (f *rotateFile) compress(backup string) error {
+	src, err := os.Open(backup)
+	if err != nil {
+		return errors.Wrapf(err, "open rotated log file [%s] failed", backup)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(backup+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "create compressed log file [%s.gz] failed", backup)
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(backup + ".gz")
+		return errors.Wrapf(err, "compress log file [%s] failed", backup)
+	}
+	if err = f.chown(backup + ".gz"); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Remove(backup), "remove rotated log file [%s] failed", backup)
+}
+
+// prune removes the oldest rotated files beyond MaxBackups
+func (f *rotateFile) prune() error {
+	if f.cfg.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(backups)-f.cfg.MaxBackups; i++ {
+		if err = os.Remove(backups[i]); err != nil {
+			return errors.Wrapf(err, "remove rotated log file [%s] failed", backups[i])
+		}
+	}
+	return nil
+}
+
+// backups returns the rotated files, the oldest first
+func (f *rotateFile) backups() ([]string, error) {
+	dir, base := filepath.Split(f.path)
+	fis, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, name := range fis {
+		if strings.HasPrefix(name, base+".") {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open log directory [%s] failed", dir)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	return names, errors.Wrapf(err, "read log directory [%s] failed", dir)
+}
+
+// Close closes the file and waits for the background compressing and pruning
+func (f *rotateFile) Close() error {
+	f.mu.Lock()
+	var err error
+	f.closed = true
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+	f.bgWg.Wait()
+	return errors.Wrapf(err, "close log file [%s] failed", f.path)
+}
@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSyslogNetwork = "unixgram"
+	defaultSyslogAddress = "/dev/log"
+	// defaultSyslogFacility is LOG_DAEMON
+	defaultSyslogFacility = 3
+	// syslogSDID is the SD-ID of the structured data holding the fields
+	syslogSDID = "tipervisor@32473"
+	// DaemonField is the field added to the forwarded lines to identify the daemon
+	DaemonField = "TIPERVISOR_DAEMON"
+	// FileField is the field added to the lines tailed from log files, the value is the path
+	FileField = "TIPERVISOR_FILE"
+)
+
+// Severities of the forwarded lines, shared by syslog and journald
+const (
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// sdEscaper escapes the values of structured data
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// fieldNamePattern is the valid field name of journald, it's also valid for syslog structured data
+var fieldNamePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_]*$`)
+
+// severity returns the severity of the lines in the stream, warning for stderr and info for stdout
+func (s Stream) severity() int {
+	if s == Stderr {
+		return severityWarning
+	}
+	return severityInfo
+}
+
+// checkFields validates the names of custom fields and adds the daemon field
+func checkFields(name string, fields map[string]string) (map[string]string, error) {
+	out := map[string]string{DaemonField: name}
+	for k, v := range fields {
+		if !fieldNamePattern.MatchString(k) || len(k) > 32 {
+			return nil, errors.Errorf("invalid field name [%s]", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// SyslogConfig configures the forwarding of a daemon's output to syslog
+type SyslogConfig struct {
+	// Name is the daemon name
+	Name string
+	// Network is unixgram or udp, default is unixgram
+	Network string
+	// Address is the socket path or host:port, default is /dev/log
+	Address string
+	// Identifier is the APP-NAME, default is Name
+	Identifier string
+	// Facility is the syslog facility code, default is LOG_DAEMON
+	Facility int
+	// Fields are sent as structured data together with TIPERVISOR_DAEMON
+	Fields map[string]string
+}
+
+// SyslogSinkFactory forwards each line of the output to syslog in RFC 5424 format
+type SyslogSinkFactory struct {
+	cfg      SyslogConfig
+	hostname string
+	sd       string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogSinkFactory connects to the syslog socket
+func NewSyslogSinkFactory(cfg SyslogConfig) (*SyslogSinkFactory, error) {
+	if cfg.Network == "" {
+		cfg.Network = defaultSyslogNetwork
+	}
+	switch cfg.Network {
+	case "unixgram", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.Errorf("unsupported syslog network [%s]", cfg.Network)
+	}
+	if cfg.Address == "" {
+		cfg.Address = defaultSyslogAddress
+	}
+	if cfg.Identifier == "" {
+		cfg.Identifier = cfg.Name
+	}
+	if cfg.Facility == 0 {
+		cfg.Facility = defaultSyslogFacility
+	}
+	if cfg.Facility < 0 || cfg.Facility > 23 {
+		return nil, errors.Errorf("invalid syslog facility [%d]", cfg.Facility)
+	}
+	fields, err := checkFields(cfg.Name, cfg.Fields)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	f := &SyslogSinkFactory{
+		cfg:      cfg,
+		hostname: hostname,
+		sd:       syslogStructuredData(fields),
+	}
+	if err = f.dial(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *SyslogSinkFactory) dial() error {
+	conn, err := net.Dial(f.cfg.Network, f.cfg.Address)
+	if err != nil {
+		return errors.Wrapf(err, "connect to syslog [%s] failed", f.cfg.Address)
+	}
+	f.conn = conn
+	return nil
+}
+
+// syslogStructuredData formats the fields as an SD-ELEMENT, the names are sorted
+func syslogStructuredData(fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("[" + syslogSDID)
+	for _, k := range names {
+		fmt.Fprintf(&b, ` %s="%s"`, k, sdEscaper.Replace(fields[k]))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// format returns the RFC 5424 message of the line
+func (f *SyslogSinkFactory) format(l *Line) []byte {
+	sd := f.sd
+	if l.Source != "" {
+		sd = fmt.Sprintf(`%s %s="%s"]`, strings.TrimSuffix(sd, "]"), FileField, sdEscaper.Replace(l.Source))
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s - %s %s ",
+		f.cfg.Facility*8+l.Stream.severity(), l.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		f.hostname, f.cfg.Identifier, l.Stream, sd)
+	b.Write(bytes.TrimSuffix(l.Data, []byte("\n")))
+	return b.Bytes()
+}
+
+// write sends the line read from the pipe
+func (f *SyslogSinkFactory) write(s Stream, data []byte) {
+	f.writeLine(&Line{Stream: s, Time: time.Now(), Data: data})
+}
+
+// writeLine sends the line, it reconnects once if the socket is broken, e.g. syslog is restarted
+func (f *SyslogSinkFactory) writeLine(l *Line) {
+	msg := f.format(l)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return
+	}
+	_, err := f.conn.Write(msg)
+	if err != nil {
+		f.conn.Close()
+		if err = f.dial(); err == nil {
+			_, err = f.conn.Write(msg)
+		}
+	}
+	if err != nil {
+		log.WithField("daemon", f.cfg.Name).Warnf("write syslog failed: %v", err)
+	}
+}
+
+// NewLogSink creates a log sink forwarding to syslog
+func (f *SyslogSinkFactory) NewLogSink() LogSink {
+	return &SyslogSink{factory: f}
+}
+
+// Close closes the syslog connection
+func (f *SyslogSinkFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return errors.Wrap(err, "close syslog connection failed")
+}
+
+// SyslogSink forwards the output of a process to syslog
+type SyslogSink struct {
+	factory *SyslogSinkFactory
+	reader  pipeReader
+}
+
+// Start gets log sink to work
+func (s *SyslogSink) Start(pout, perr *os.File) {
+	s.reader.start(pout, perr, s.factory.write)
+}
+
+// WriteLine forwards the line
+func (s *SyslogSink) WriteLine(l *Line) {
+	s.factory.writeLine(l)
+}
+
+// Stop terminates log sink after the output is drained
+func (s *SyslogSink) Stop() {
+	s.reader.stop()
+}
@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenUnixgram creates a local datagram socket standing in for syslog or journald
+func listenUnixgram(t *testing.T) (*net.UnixConn, string, func()) {
+	dir, err := ioutil.TempDir("", "test_unixgram")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.NoError(t, err)
+	return conn, path, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, maxLineSize)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSyslogSink(t *testing.T) {
+	conn, path, cleanup := listenUnixgram(t)
+	defer cleanup()
+
+	f, err := NewSyslogSinkFactory(SyslogConfig{
+		Name:    "tidb",
+		Address: path,
+		Fields:  map[string]string{"CLUSTER": `a"b]c`},
+	})
+	assert.NoError(t, err)
+	defer f.Close()
+	s := f.NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString("hello\n")
+	msg := readDatagram(t, conn)
+	pattern := `^<30>1 \S+ \S+ tidb - stdout \[tipervisor@32473 CLUSTER="a\\"b\\]c" TIPERVISOR_DAEMON="tidb"\] hello$`
+	assert.Regexp(t, regexp.MustCompile(pattern), msg)
+	perr.WriteString("oops\n")
+	msg = readDatagram(t, conn)
+	assert.Regexp(t, regexp.MustCompile(`^<28>1 .* tidb - stderr .* oops$`), msg)
+	pout.Close()
+	perr.Close()
+	s.Stop()
+}
+
+func TestSyslogConfig(t *testing.T) {
+	_, err := NewSyslogSinkFactory(SyslogConfig{Name: "tidb", Network: "tcp", Address: "127.0.0.1:514"})
+	assert.Error(t, err)
+	_, err = NewSyslogSinkFactory(SyslogConfig{Name: "tidb", Fields: map[string]string{"bad name": ""}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package sink
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// unifiedLogTimeFormat is the time format of the unified log format
+const unifiedLogTimeFormat = "2006/01/02 15:04:05.000 -07:00"
+
+// LogField is a key value pair of a log record
+type LogField struct {
+	Key   string
+	Value string
+}
+
+// LogRecord is a line of the unified log format used by TiDB, TiKV and PD, e.g.
+// [2019/01/28 15:02:41.370 +08:00] [INFO] [main.go:225] ["server is running"] [addr=0.0.0.0:4000]
+type LogRecord struct {
+	Time    time.Time
+	Level   string
+	Source  string
+	Message string
+	Fields  []LogField
+}
+
+// ParseUnifiedLog parses a line of the unified log format
+func ParseUnifiedLog(line string) (*LogRecord, error) {
+	var (
+		segs []string
+		rest = strings.TrimSpace(line)
+	)
+	for rest != "" {
+		seg, r, err := parseLogSegment(rest)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, seg)
+		rest = strings.TrimLeft(r, " ")
+	}
+	if len(segs) < 4 {
+		return nil, errors.Errorf("too few segments in log [%s]", line)
+	}
+	t, err := time.Parse(unifiedLogTimeFormat, segs[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid log time")
+	}
+	r := &LogRecord{
+		Time:    t,
+		Level:   strings.ToUpper(segs[1]),
+		Source:  segs[2],
+		Message: unquoteLogValue(segs[3]),
+	}
+	for _, seg := range segs[4:] {
+		i := strings.IndexByte(seg, '=')
+		if i < 0 {
+			return nil, errors.Errorf("invalid log field [%s]", seg)
+		}
+		r.Fields = append(r.Fields, LogField{
+			Key:   unquoteLogValue(seg[:i]),
+			Value: unquoteLogValue(seg[i+1:]),
+		})
+	}
+	return r, nil
+}
+
+// parseLogSegment returns the content of the leading [...] segment and the rest,
+// the brackets inside quoted strings are skipped
+func parseLogSegment(s string) (string, string, error) {
+	if s[0] != '[' {
+		return "", "", errors.Errorf("log segment [%s] doesn't start with [", s)
+	}
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == ']':
+			return s[1:i], s[i+1:], nil
+		}
+	}
+	return "", "", errors.Errorf("log segment [%s] isn't closed", s)
+}
+
+// unquoteLogValue removes the quotes and escapes of the value if it's quoted
+func unquoteLogValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	if u, err := strconv.Unquote(v); err == nil {
+		return u
+	}
+	return v[1 : len(v)-1]
+}
+
+// logrusLevel returns the logrus level of the record level, FATAL is logged as
+// ERROR since it makes logrus exit the supervisor
+func logrusLevel(level string) logrus.Level {
+	switch level {
+	case "DEBUG", "TRACE":
+		return logrus.DebugLevel
+	case "WARN", "WARNING":
+		return logrus.WarnLevel
+	case "ERROR", "FATAL", "CRITICAL":
+		return logrus.ErrorLevel
+	default:
+		return logrus.InfoLevel
+	}
+}
+
+// UnifiedLogSinkFactory parses the output of TiDB, TiKV and PD in the unified log format,
+// and re-emits the records through pkg/util/log with the daemon field and the original level.
+// The lines not in the format continue the last record of the same output at its level,
+// e.g. the stacks of multi-line messages, or at WARN level if there is no record yet.
+// A panic starts at ERROR level, so its goroutine stacks are emitted at ERROR level too
+type UnifiedLogSinkFactory struct {
+	name string
+	next LogSinkFactory
+}
+
+// NewUnifiedLogSinkFactory creates a parsing log sink factory for the daemon,
+// the output is also teed to the sinks of the next factory if it's not nil
+func NewUnifiedLogSinkFactory(name string, next LogSinkFactory) *UnifiedLogSinkFactory {
+	return &UnifiedLogSinkFactory{
+		name: name,
+		next: next,
+	}
+}
+
+// NewLogSink creates a parsing log sink
+func (f *UnifiedLogSinkFactory) NewLogSink() LogSink {
+	s := &UnifiedLogSink{name: f.name, levels: make(map[lineOrigin]logrus.Level)}
+	if f.next == nil {
+		return s
+	}
+	return &MultiLogSink{
+		outputs: []*teeOutput{newTeeOutput(s), newTeeOutput(f.next.NewLogSink())},
+	}
+}
+
+// UnifiedLogSink parses the output of a process and re-emits the records
+type UnifiedLogSink struct {
+	name   string
+	reader pipeReader
+	mu     sync.Mutex
+	// levels keeps the level of the last record of each output
+	levels map[lineOrigin]logrus.Level
+}
+
+// lineOrigin is the output a line comes from, the stream of the process or a tailed file
+type lineOrigin struct {
+	stream Stream
+	source string
+}
+
+// Start gets log sink to work
+func (s *UnifiedLogSink) Start(pout, perr *os.File) {
+	s.reader.start(pout, perr, func(st Stream, data []byte) {
+		s.WriteLine(&Line{Stream: st, Data: bytes.TrimSuffix(data, []byte("\n"))})
+	})
+}
+
+// WriteLine parses and re-emits the line
+func (s *UnifiedLogSink) WriteLine(l *Line) {
+	line := string(l.Data)
+	origin := lineOrigin{stream: l.Stream, source: l.Source}
+	r, err := ParseUnifiedLog(line)
+	if err != nil {
+		entry := log.WithFields(log.Fields{"daemon": s.name, "stream": l.Stream.String()})
+		if l.Source != "" {
+			entry = entry.WithField("file", l.Source)
+		}
+		if isPanicLine(line) {
+			s.setLevel(origin, logrus.ErrorLevel)
+			entry.WithField("panic", true).Error(line)
+		} else {
+			entry.Log(s.level(origin), line)
+		}
+		return
+	}
+	s.setLevel(origin, logrusLevel(r.Level))
+	fields := make(log.Fields, len(r.Fields)+3)
+	for _, f := range r.Fields {
+		fields[f.Key] = f.Value
+	}
+	fields["daemon"] = s.name
+	fields["source"] = r.Source
+	if l.Source != "" {
+		fields["file"] = l.Source
+	}
+	log.WithFields(fields).WithTime(r.Time).Log(logrusLevel(r.Level), r.Message)
+}
+
+// level returns the level of the last record of the output, WARN if there is none
+func (s *UnifiedLogSink) level(origin lineOrigin) logrus.Level {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level, ok := s.levels[origin]; ok {
+		return level
+	}
+	return logrus.WarnLevel
+}
+
+func (s *UnifiedLogSink) setLevel(origin lineOrigin, level logrus.Level) {
+	s.mu.Lock()
+	s.levels[origin] = level
+	s.mu.Unlock()
+}
+
+// isPanicLine returns true if the line starts a panic printed by Go or Rust runtime
+func isPanicLine(line string) bool {
+	return strings.HasPrefix(line, "panic: ") ||
+		strings.HasPrefix(line, "fatal error: ") ||
+		strings.HasPrefix(line, "thread '") && strings.Contains(line, "' panicked at")
+}
+
+// Stop terminates log sink after the output is drained
+func (s *UnifiedLogSink) Stop() {
+	s.reader.stop()
+}
@@ -0,0 +1,115 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipervisor/pkg/util/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnifiedLog(t *testing.T) {
+	r, err := ParseUnifiedLog(`[2019/01/28 15:02:41.370 +08:00] [INFO] [main.go:225] ["server is [running]"] [addr=0.0.0.0:4000] [sql="select \"a]\""]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", r.Level)
+	assert.Equal(t, "main.go:225", r.Source)
+	assert.Equal(t, "server is [running]", r.Message)
+	assert.Equal(t, []LogField{{"addr", "0.0.0.0:4000"}, {"sql", `select "a]"`}}, r.Fields)
+	assert.True(t, r.Time.Equal(time.Date(2019, 1, 28, 7, 2, 41, 370000000, time.UTC)))
+
+	r, err = ParseUnifiedLog(`[2019/01/28 15:02:41.370 +08:00] [WARN] [<unknown>] [welcome]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "welcome", r.Message)
+	assert.Empty(t, r.Fields)
+
+	for _, line := range []string{
+		"panic: runtime error",
+		"[2019/01/28 15:02:41.370 +08:00] [INFO] [main.go:225]",
+		`[2019/01/28 15:02:41.370 +08:00] [INFO] [main.go:225] ["unclosed]`,
+		"[yesterday] [INFO] [main.go:225] [msg]",
+		"[2019/01/28 15:02:41.370 +08:00] [INFO] [main.go:225] [msg] [no value]",
+	} {
+		_, err = ParseUnifiedLog(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestUnifiedLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(new(logrus.JSONFormatter))
+	log.SetLevel(logrus.DebugLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(new(logrus.TextFormatter))
+		log.SetLevel(logrus.InfoLevel)
+	}()
+
+	ring := NewRingLogSinkFactory(RingLogConfig{})
+	s := NewUnifiedLogSinkFactory("tidb", ring).NewLogSink()
+	pout, perr := startPipes(t, s)
+	pout.WriteString(`[2019/01/28 15:02:41.370 +08:00] [ERROR] [server.go:12] ["accept failed"] [conn=1]` + "\n")
+	perr.WriteString("panic: runtime error: index out of range\n")
+	pout.Close()
+	perr.Close()
+	s.Stop()
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		records = append(records, r)
+	}
+	assert.Len(t, records, 2)
+	if records[0]["panic"] != nil {
+		records[0], records[1] = records[1], records[0]
+	}
+	assert.Equal(t, "error", records[0]["level"])
+	assert.Equal(t, "accept failed", records[0]["msg"])
+	assert.Equal(t, "tidb", records[0]["daemon"])
+	assert.Equal(t, "server.go:12", records[0]["source"])
+	assert.Equal(t, "1", records[0]["conn"])
+	assert.True(t, strings.HasPrefix(records[0]["time"].(string), "2019-01-28T"))
+	assert.Equal(t, "error", records[1]["level"])
+	assert.Equal(t, true, records[1]["panic"])
+	assert.Equal(t, "stderr", records[1]["stream"])
+	// the output is also passed to the next sink
+	assert.Len(t, ring.Tail(-1), 2)
+}
+
+func TestUnifiedLogSinkContinuation(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(new(logrus.JSONFormatter))
+	log.SetLevel(logrus.DebugLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(new(logrus.TextFormatter))
+		log.SetLevel(logrus.InfoLevel)
+	}()
+
+	s := NewUnifiedLogSinkFactory("tidb", nil).NewLogSink().(*UnifiedLogSink)
+	for _, l := range []*Line{
+		{Stream: Stdout, Data: []byte("not in the unified format")},
+		{Stream: Stdout, Data: []byte(`[2019/01/28 15:02:41.370 +08:00] [INFO] [server.go:12] ["multi-line"]`)},
+		{Stream: Stdout, Data: []byte("  the rest of the message")},
+		{Stream: Stderr, Data: []byte("panic: runtime error: index out of range")},
+		{Stream: Stderr, Data: []byte("goroutine 1 [running]:")},
+		{Stream: Stdout, Source: "tidb.log", Data: []byte("\tmain.main()")},
+	} {
+		s.WriteLine(l)
+	}
+
+	var levels []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		levels = append(levels, r["level"].(string))
+	}
+	assert.Equal(t, []string{"warning", "info", "info", "error", "error", "warning"}, levels)
+}
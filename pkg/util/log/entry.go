@@ -1,6 +1,8 @@
 package log
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -33,6 +35,18 @@ func (entry *Entry) WithFields(fields Fields) *Entry {
 	return (*Entry)(l.WithFields(f))
 }
 
+// WithTime overrides the time of the Entry.
+func (entry *Entry) WithTime(t time.Time) *Entry {
+	l := (*logrus.Entry)(entry)
+	return (*Entry)(l.WithTime(t))
+}
+
+// Log logs a message at the given level on the logrus logger.
+func (entry *Entry) Log(level logrus.Level, args ...interface{}) {
+	l := (*logrus.Entry)(entry)
+	l.Log(level, args...)
+}
+
 // Debug logs a message at level Debug on the logrus logger.
 func (entry *Entry) Debug(args ...interface{}) {
 	l := (*logrus.Entry)(entry)